@@ -0,0 +1,382 @@
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"github.com/StellarisJAY/my-container/common"
+	"github.com/StellarisJAY/my-container/container"
+	"github.com/StellarisJAY/my-container/image"
+	"github.com/StellarisJAY/my-container/util"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Options build命令的参数
+type Options struct {
+	// Tag 构建完成的镜像的name:tag
+	Tag string
+	// Dockerfile 为空时使用构建上下文中的Dockerfile
+	Dockerfile string
+	// ContextDir 构建上下文目录，COPY和ADD的源文件都在这个目录中
+	ContextDir string
+	// NoCache 不使用构建缓存，每一步都重新执行
+	NoCache bool
+	// Container RUN的临时容器的CPU和内存配额
+	Container container.Options
+}
+
+// builder 构建过程的状态，imageHash为上一步生成的镜像，FROM scratch之后第一步之前为空
+type builder struct {
+	opts      *Options
+	imageHash string
+	// cmdSet 本次构建中执行过CMD，之后的ENTRYPOINT不再清空CMD
+	cmdSet bool
+}
+
+// Build 按照Dockerfile构建镜像，每一步生成一个没有tag的镜像并记录在构建缓存中，
+// 最后为镜像添加tag，返回镜像hash
+func Build(opts *Options) (string, error) {
+	if _, err := name.NewTag(opts.Tag); err != nil {
+		return "", fmt.Errorf("invalid image tag %q %w", opts.Tag, err)
+	}
+	contextDir, err := filepath.Abs(opts.ContextDir)
+	if err != nil {
+		return "", err
+	}
+	if contextDir, err = filepath.EvalSymlinks(contextDir); err != nil {
+		return "", fmt.Errorf("unable to read build context %w", err)
+	}
+	opts.ContextDir = contextDir
+	dockerfile := opts.Dockerfile
+	if dockerfile == "" {
+		dockerfile = filepath.Join(contextDir, "Dockerfile")
+	}
+	f, err := os.Open(dockerfile)
+	if err != nil {
+		return "", fmt.Errorf("unable to open Dockerfile %w", err)
+	}
+	defer f.Close()
+	instructions, err := parseDockerfile(f)
+	if err != nil {
+		return "", err
+	}
+	if len(instructions) == 0 || instructions[0].cmd != "FROM" {
+		return "", errors.New("Dockerfile must begin with a FROM instruction")
+	}
+	b := &builder{opts: opts}
+	for i, inst := range instructions {
+		if i > 0 && inst.cmd == "FROM" {
+			return "", fmt.Errorf("line %d: multi-stage builds are not supported", inst.line)
+		}
+		log.Printf("Step %d/%d : %s", i+1, len(instructions), inst)
+		if err := b.dispatch(inst); err != nil {
+			return "", fmt.Errorf("line %d: %s: %w", inst.line, inst.cmd, err)
+		}
+		log.Printf(" ---> %s", b.imageHash)
+	}
+	if b.imageHash == "" {
+		return "", errors.New("no image was built from scratch")
+	}
+	if err := image.Tag(b.imageHash, opts.Tag); err != nil {
+		return "", err
+	}
+	return b.imageHash, nil
+}
+
+func (b *builder) dispatch(inst *instruction) error {
+	if inst.cmd == "FROM" {
+		return b.from(inst)
+	}
+	config, err := b.config()
+	if err != nil {
+		return err
+	}
+	env := envMap(config.Config.Env)
+	switch inst.cmd {
+	case "RUN":
+		return b.run(inst, config)
+	case "COPY", "ADD":
+		return b.copy(inst, config, env)
+	case "ENV":
+		pairs, err := parseKeyValues(inst, env)
+		if err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			config.Config.Env = setEnv(config.Config.Env, pair[0], pair[1])
+		}
+	case "LABEL":
+		pairs, err := parseKeyValues(inst, env)
+		if err != nil {
+			return err
+		}
+		if config.Config.Labels == nil {
+			config.Config.Labels = make(map[string]string)
+		}
+		for _, pair := range pairs {
+			config.Config.Labels[pair[0]] = pair[1]
+		}
+	case "WORKDIR":
+		dir, err := singleWord(inst, env)
+		if err != nil {
+			return err
+		}
+		// 相对路径以上一个WORKDIR为起点
+		if !path.IsAbs(dir) {
+			dir = path.Join("/", config.Config.WorkingDir, dir)
+		}
+		config.Config.WorkingDir = path.Clean(dir)
+	case "USER":
+		user, err := singleWord(inst, env)
+		if err != nil {
+			return err
+		}
+		config.Config.User = user
+	case "CMD":
+		config.Config.Cmd = inst.command()
+		b.cmdSet = true
+	case "ENTRYPOINT":
+		config.Config.Entrypoint = inst.command()
+		// 和docker一样，ENTRYPOINT清空基础镜像的CMD
+		if !b.cmdSet {
+			config.Config.Cmd = nil
+		}
+	case "EXPOSE":
+		ports, err := shellWords(inst.args, env)
+		if err != nil {
+			return err
+		}
+		if config.Config.ExposedPorts == nil {
+			config.Config.ExposedPorts = make(map[string]struct{})
+		}
+		for _, port := range ports {
+			normalized, err := parsePort(port)
+			if err != nil {
+				return err
+			}
+			config.Config.ExposedPorts[normalized] = struct{}{}
+		}
+	case "VOLUME":
+		volumes, ok := inst.jsonArgs()
+		if !ok {
+			if volumes, err = shellWords(inst.args, env); err != nil {
+				return err
+			}
+		}
+		if config.Config.Volumes == nil {
+			config.Config.Volumes = make(map[string]struct{})
+		}
+		for _, volume := range volumes {
+			config.Config.Volumes[volume] = struct{}{}
+		}
+	default:
+		return errors.New("unsupported instruction")
+	}
+	return b.step(inst, "", func() (string, error) {
+		return image.CreateImage(b.imageHash, "", config, b.history(inst))
+	})
+}
+
+// from 拉取基础镜像，scratch表示从空镜像开始
+func (b *builder) from(inst *instruction) error {
+	words, err := shellWords(inst.args, nil)
+	if err != nil {
+		return err
+	}
+	if len(words) == 3 && strings.EqualFold(words[1], "AS") {
+		words = words[:1]
+	}
+	if len(words) != 1 {
+		return errors.New("requires exactly one image")
+	}
+	if words[0] == "scratch" {
+		return nil
+	}
+	imageHash, err := image.PullImage(words[0], image.PullOptions{})
+	if err != nil {
+		return err
+	}
+	if err := image.VerifyImage(words[0], imageHash); err != nil {
+		return err
+	}
+	// 每一步都在基础镜像上创建新镜像，lazy pull的镜像没有完整的layer文件
+	if err := image.CheckFullyPulled(imageHash); err != nil {
+		return err
+	}
+	b.imageHash = imageHash
+	return nil
+}
+
+// config 读取上一步镜像的config，FROM scratch时返回空的config
+func (b *builder) config() (*v1.ConfigFile, error) {
+	if b.imageHash == "" {
+		return &v1.ConfigFile{
+			Architecture: runtime.GOARCH,
+			OS:           "linux",
+			RootFS:       v1.RootFS{Type: "layers"},
+		}, nil
+	}
+	return image.ParseConfig(b.imageHash)
+}
+
+func (b *builder) history(inst *instruction) v1.History {
+	return v1.History{CreatedBy: inst.String(), Comment: "my-container build"}
+}
+
+// step 执行一个构建步骤，父镜像、指令和content相同的步骤直接使用缓存的镜像
+func (b *builder) step(inst *instruction, content string, build func() (string, error)) error {
+	parent := b.imageHash
+	if parent == "" {
+		parent = "scratch"
+	}
+	key := cacheKey(parent, inst.String(), content)
+	if !b.opts.NoCache {
+		if imageHash, ok := lookupCache(key); ok {
+			log.Println(" ---> Using cache")
+			b.imageHash = imageHash
+			return nil
+		}
+	}
+	imageHash, err := build()
+	if err != nil {
+		return err
+	}
+	if err := storeCache(key, imageHash); err != nil {
+		log.Println("Unable to save build cache: ", err)
+	}
+	b.imageHash = imageHash
+	return nil
+}
+
+// run 在上一步镜像的临时容器中执行命令，提交容器中的修改
+func (b *builder) run(inst *instruction, config *v1.ConfigFile) error {
+	if b.imageHash == "" {
+		return errors.New("cannot RUN in an empty scratch image")
+	}
+	args := inst.command()
+	return b.step(inst, "", func() (string, error) {
+		return b.commitContainer(config, inst, func(containerId string) error {
+			opts := b.opts.Container
+			opts.Env, opts.WorkingDir, opts.User = config.Config.Env, config.Config.WorkingDir, config.Config.User
+			exitCode, err := container.RunStep(&opts, containerId, append([]string{"--"}, args...))
+			if err != nil {
+				return err
+			}
+			if exitCode != 0 {
+				return fmt.Errorf("command %q returned a non-zero code: %d", strings.Join(args, " "), exitCode)
+			}
+			return nil
+		})
+	})
+}
+
+// copy 将构建上下文中的文件复制到上一步镜像的临时容器中，缓存key包含源文件的内容
+func (b *builder) copy(inst *instruction, config *v1.ConfigFile, env map[string]string) error {
+	spec, err := parseCopy(inst, b.opts.ContextDir, config.Config.WorkingDir, env)
+	if err != nil {
+		return err
+	}
+	checksum, err := spec.checksum()
+	if err != nil {
+		return err
+	}
+	writeTar := func(w io.Writer) error {
+		return spec.writeTar(w, true)
+	}
+	return b.step(inst, checksum, func() (string, error) {
+		if b.imageHash == "" {
+			return b.commitDir(config, inst, writeTar)
+		}
+		return b.commitContainer(config, inst, func(containerId string) error {
+			return container.ExtractToContainer(containerId, writeTar)
+		})
+	})
+}
+
+// commitContainer 从上一步的镜像创建临时容器，执行change后将容器的修改提交为新镜像，最后删除容器
+func (b *builder) commitContainer(config *v1.ConfigFile, inst *instruction, change func(containerId string) error) (string, error) {
+	containerId, err := container.CreateContainer(b.imageHash)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := container.Remove(containerId); err != nil {
+			log.Println("Unable to remove build container: ", err)
+		}
+		image.UnmountLazyLayers()
+	}()
+	if err := change(containerId); err != nil {
+		return "", err
+	}
+	return container.CommitLayer(containerId, config, b.history(inst))
+}
+
+// commitDir FROM scratch之后没有可以创建容器的镜像，将文件解压到临时目录作为第一个layer
+func (b *builder) commitDir(config *v1.ConfigFile, inst *instruction, writeTar func(w io.Writer) error) (string, error) {
+	_ = util.CreateDirsIfNotExist([]string{common.TempDir})
+	dir, err := os.MkdirTemp(common.TempDir, "build-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	r, w := io.Pipe()
+	go func() {
+		_ = w.CloseWithError(writeTar(w))
+	}()
+	if err := util.UntarReader(r, dir, nil); err != nil {
+		_ = r.CloseWithError(err)
+		return "", err
+	}
+	return image.CreateImage("", dir, config, b.history(inst))
+}
+
+func singleWord(inst *instruction, env map[string]string) (string, error) {
+	words, err := shellWords(inst.args, env)
+	if err != nil {
+		return "", err
+	}
+	if len(words) != 1 {
+		return "", errors.New("requires exactly one argument")
+	}
+	return words[0], nil
+}
+
+// parsePort 将EXPOSE的端口规范化为port/protocol，默认为tcp
+func parsePort(port string) (string, error) {
+	number, protocol, ok := strings.Cut(port, "/")
+	if !ok {
+		protocol = "tcp"
+	}
+	protocol = strings.ToLower(protocol)
+	if number == "" || strings.Trim(number, "0123456789-") != "" || (protocol != "tcp" && protocol != "udp" && protocol != "sctp") {
+		return "", fmt.Errorf("invalid port %s", port)
+	}
+	return number + "/" + protocol, nil
+}
+
+func envMap(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		m[key] = value
+	}
+	return m
+}
+
+// setEnv 设置环境变量，已经存在的变量被替换
+func setEnv(env []string, key, value string) []string {
+	for i, kv := range env {
+		if k, _, _ := strings.Cut(kv, "="); k == key {
+			env[i] = key + "=" + value
+			return env
+		}
+	}
+	return append(env, key+"="+value)
+}
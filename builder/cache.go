@@ -0,0 +1,61 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/StellarisJAY/my-container/common"
+	"github.com/StellarisJAY/my-container/image"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// cacheDBFile 构建缓存，记录每个构建步骤生成的镜像
+	cacheDBFile = common.ImageBaseDir + "build-cache.db"
+	cacheBucket = "cache"
+)
+
+// cacheKey 构建步骤的缓存key，由父镜像、指令和COPY/ADD的文件内容决定
+func cacheKey(parent, instruction, content string) string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s\n%s\n%s", parent, instruction, content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// lookupCache 查找缓存的镜像，镜像已经被删除时视为没有缓存
+func lookupCache(key string) (string, bool) {
+	db, err := bolt.Open(cacheDBFile, 0644, nil)
+	if err != nil {
+		return "", false
+	}
+	defer db.Close()
+	var imageHash string
+	_ = db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(cacheBucket)); b != nil {
+			imageHash = string(b.Get([]byte(key)))
+		}
+		return nil
+	})
+	if imageHash == "" {
+		return "", false
+	}
+	if _, err := image.ParseManifest(imageHash); err != nil {
+		return "", false
+	}
+	return imageHash, true
+}
+
+func storeCache(key, imageHash string) error {
+	db, err := bolt.Open(cacheDBFile, 0644, nil)
+	if err != nil {
+		return fmt.Errorf("unable to open build cache %w", err)
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(cacheBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), []byte(imageHash))
+	})
+}
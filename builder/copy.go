@@ -0,0 +1,233 @@
+package builder
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/StellarisJAY/my-container/util"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// copySpec COPY和ADD的源文件和容器中的目标路径
+type copySpec struct {
+	// sources 构建上下文中的源文件，都在上下文目录之内
+	sources []string
+	dest    string
+	// destDir 目标为目录，源文件复制到目录中
+	destDir bool
+	// extract ADD的本地tar包解压到目标目录
+	extract bool
+}
+
+// parseCopy 解析COPY和ADD的参数，源文件支持通配符，相对的目标路径以workDir为起点
+func parseCopy(inst *instruction, contextDir, workDir string, env map[string]string) (*copySpec, error) {
+	args, ok := inst.jsonArgs()
+	if !ok {
+		var err error
+		if args, err = shellWords(inst.args, env); err != nil {
+			return nil, err
+		}
+	}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--") {
+			return nil, fmt.Errorf("flag %s is not supported", arg)
+		}
+	}
+	if len(args) < 2 {
+		return nil, errors.New("requires at least two arguments")
+	}
+	dest := args[len(args)-1]
+	spec := &copySpec{
+		dest:    path.Join("/", workDir, dest),
+		destDir: strings.HasSuffix(dest, "/") || dest == ".",
+		extract: inst.cmd == "ADD",
+	}
+	if path.IsAbs(dest) {
+		spec.dest = path.Clean(dest)
+	}
+	for _, src := range args[:len(args)-1] {
+		if strings.Contains(src, "://") {
+			return nil, fmt.Errorf("remote URL %s is not supported", src)
+		}
+		matches, err := contextGlob(contextDir, src)
+		if err != nil {
+			return nil, err
+		}
+		spec.sources = append(spec.sources, matches...)
+	}
+	if len(spec.sources) > 1 && !spec.destDir {
+		return nil, errors.New("when using more than one source file, the destination must be a directory and end with a /")
+	}
+	return spec, nil
+}
+
+// contextGlob 在构建上下文中匹配src，src中的..和符号链接都不会离开上下文目录
+func contextGlob(contextDir, src string) ([]string, error) {
+	pattern := filepath.Join(contextDir, filepath.Clean("/"+src))
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source %s %w", src, err)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("%s: no such file or directory in build context", src)
+	}
+	for _, match := range matches {
+		// 匹配结果本身按原样复制，符号链接不会被跟随，只需要检查它的父目录
+		rel, _ := filepath.Rel(contextDir, filepath.Dir(match))
+		parent, err := util.SecureJoin(contextDir, rel)
+		if err != nil {
+			return nil, err
+		}
+		if parent != filepath.Dir(match) {
+			return nil, fmt.Errorf("%s is outside of the build context", src)
+		}
+	}
+	return matches, nil
+}
+
+// checksum 计算源文件的路径、权限和内容的sha256，作为构建缓存key的一部分，不包含修改时间
+func (c *copySpec) checksum() (string, error) {
+	h := sha256.New()
+	if err := c.writeTar(h, false); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeTar 将源文件打包为tar，归档中的路径为容器中的目标路径，复制的文件属于root，
+// ADD解压的tar包保留原来的所有者
+func (c *copySpec) writeTar(w io.Writer, keepTimes bool) error {
+	tw := tar.NewWriter(w)
+	for _, src := range c.sources {
+		info, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+		target := c.dest
+		if c.destDir && !info.IsDir() {
+			target = path.Join(c.dest, filepath.Base(src))
+		}
+		if c.extract && info.Mode().IsRegular() {
+			if ok, err := c.writeArchive(tw, src, keepTimes); err != nil {
+				return err
+			} else if ok {
+				continue
+			}
+		}
+		err = filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(src, file)
+			if err != nil {
+				return err
+			}
+			return writeEntry(tw, file, info, path.Join(target, filepath.ToSlash(rel)), keepTimes)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeEntry(tw *tar.Writer, file string, info os.FileInfo, target string, keepTimes bool) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(file); err != nil {
+			return err
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return fmt.Errorf("unable to copy %s %w", file, err)
+	}
+	header.Name = strings.TrimPrefix(target, "/")
+	if header.Name == "" {
+		// 目标为根目录时不修改根目录本身
+		return nil
+	}
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+	if !keepTimes {
+		header.ModTime, header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}, time.Time{}
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// writeArchive ADD的源文件是tar包（可以是gzip或zstd压缩的）时，将其中的文件解压到目标目录，
+// 不是tar包时返回false，按普通文件复制
+func (c *copySpec) writeArchive(tw *tar.Writer, src string, keepTimes bool) (bool, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	r, _, err := util.DecompressReader(f)
+	if err != nil {
+		return false, nil
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	header, err := tr.Next()
+	if err != nil {
+		return false, nil
+	}
+	for {
+		if header.Name, err = c.archivePath(header.Name); err != nil {
+			return true, err
+		}
+		if header.Typeflag == tar.TypeLink {
+			if header.Linkname, err = c.archivePath(header.Linkname); err != nil {
+				return true, err
+			}
+		}
+		if !keepTimes {
+			header.ModTime, header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}, time.Time{}
+		}
+		if header.Name != "" {
+			if err := tw.WriteHeader(header); err != nil {
+				return true, err
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return true, err
+			}
+		}
+		if header, err = tr.Next(); errors.Is(err, io.EOF) {
+			return true, nil
+		} else if err != nil {
+			return true, fmt.Errorf("unable to read archive %s %w", filepath.Base(src), err)
+		}
+	}
+}
+
+// archivePath 返回tar包中的路径解压到目标目录后在归档中的路径，不允许离开目标目录
+func (c *copySpec) archivePath(name string) (string, error) {
+	target := path.Join(c.dest, name)
+	if c.dest != "/" && target != c.dest && !strings.HasPrefix(target, c.dest+"/") {
+		return "", fmt.Errorf("archive entry %s is outside of %s", name, c.dest)
+	}
+	return strings.TrimPrefix(target, "/"), nil
+}
@@ -0,0 +1,212 @@
+package builder
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// instruction Dockerfile中的一条指令
+type instruction struct {
+	// cmd 大写的指令名，例如RUN
+	cmd string
+	// args 指令名之后的参数，多行指令已经拼接为一行
+	args string
+	// line 指令在Dockerfile中开始的行号
+	line int
+}
+
+// String 返回指令的文本，用于构建输出、history和构建缓存的key
+func (i *instruction) String() string {
+	return i.cmd + " " + i.args
+}
+
+// jsonArgs 解析JSON数组格式的参数，例如CMD ["nginx", "-g", "daemon off;"]，不是JSON数组时ok为false
+func (i *instruction) jsonArgs() (args []string, ok bool) {
+	if !strings.HasPrefix(i.args, "[") {
+		return nil, false
+	}
+	if err := json.Unmarshal([]byte(i.args), &args); err != nil {
+		return nil, false
+	}
+	return args, true
+}
+
+// command 返回RUN、CMD和ENTRYPOINT执行的命令，shell格式的参数使用/bin/sh -c执行
+func (i *instruction) command() []string {
+	if args, ok := i.jsonArgs(); ok {
+		return args
+	}
+	return []string{"/bin/sh", "-c", i.args}
+}
+
+// parseDockerfile 解析Dockerfile，忽略空行和#开头的注释，以\结尾的行和下一行拼接
+func parseDockerfile(r io.Reader) ([]*instruction, error) {
+	var instructions []*instruction
+	var current *instruction
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		// 多行指令中间的注释和空行同样被忽略
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		continued := strings.HasSuffix(line, "\\")
+		line = strings.TrimSpace(strings.TrimSuffix(line, "\\"))
+		if current == nil {
+			cmd, args, _ := strings.Cut(line, " ")
+			current = &instruction{cmd: strings.ToUpper(cmd), args: strings.TrimSpace(args), line: lineNum}
+		} else if line != "" {
+			current.args = strings.TrimSpace(current.args + " " + line)
+		}
+		if !continued {
+			instructions = append(instructions, current)
+			current = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current != nil {
+		instructions = append(instructions, current)
+	}
+	for _, inst := range instructions {
+		if inst.args == "" {
+			return nil, fmt.Errorf("line %d: %s requires at least one argument", inst.line, inst.cmd)
+		}
+	}
+	return instructions, nil
+}
+
+// shellWords 按照shell的规则拆分参数：空白分隔单词，支持单引号、双引号和\转义，
+// 单引号之外的$VAR、${VAR}、${VAR:-default}和${VAR:+value}使用env替换
+func shellWords(s string, env map[string]string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			continue
+		case c == '\\':
+			if i+1 < len(runes) {
+				i++
+				word.WriteRune(runes[i])
+			}
+		case c == '\'':
+			end := indexRune(runes, i+1, '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote in %q", s)
+			}
+			word.WriteString(string(runes[i+1 : end]))
+			i = end
+		case c == '"':
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				switch {
+				case runes[i] == '\\' && i+1 < len(runes) && strings.ContainsRune("\"\\$", runes[i+1]):
+					i++
+					word.WriteRune(runes[i])
+				case runes[i] == '$':
+					value, next := expandVariable(runes, i, env)
+					word.WriteString(value)
+					i = next - 1
+				default:
+					word.WriteRune(runes[i])
+				}
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated double quote in %q", s)
+			}
+		case c == '$':
+			value, next := expandVariable(runes, i, env)
+			word.WriteString(value)
+			i = next - 1
+		default:
+			word.WriteRune(c)
+		}
+		inWord = true
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// expandVariable 替换runes[start]处以$开头的变量，返回替换后的值和变量之后的位置
+func expandVariable(runes []rune, start int, env map[string]string) (string, int) {
+	i := start + 1
+	if i < len(runes) && runes[i] == '{' {
+		end := indexRune(runes, i+1, '}')
+		if end < 0 {
+			return "$", start + 1
+		}
+		expr := string(runes[i+1 : end])
+		if name, def, ok := strings.Cut(expr, ":-"); ok {
+			if value := env[name]; value != "" {
+				return value, end + 1
+			}
+			return def, end + 1
+		}
+		if name, alt, ok := strings.Cut(expr, ":+"); ok {
+			if env[name] != "" {
+				return alt, end + 1
+			}
+			return "", end + 1
+		}
+		return env[expr], end + 1
+	}
+	for i < len(runes) && (runes[i] == '_' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+		i++
+	}
+	if i == start+1 {
+		return "$", i
+	}
+	return env[string(runes[start+1:i])], i
+}
+
+func indexRune(runes []rune, from int, r rune) int {
+	for i := from; i < len(runes); i++ {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseKeyValues 解析ENV和LABEL的key=value参数，也支持旧的ENV key value格式
+func parseKeyValues(inst *instruction, env map[string]string) ([][2]string, error) {
+	words, err := shellWords(inst.args, env)
+	if err != nil {
+		return nil, err
+	}
+	if len(words) > 0 && !strings.Contains(words[0], "=") {
+		if inst.cmd != "ENV" || len(words) < 2 {
+			return nil, errors.New("requires key=value arguments")
+		}
+		return [][2]string{{words[0], strings.Join(words[1:], " ")}}, nil
+	}
+	var pairs [][2]string
+	for _, word := range words {
+		key, value, ok := strings.Cut(word, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("requires key=value arguments, got %q", word)
+		}
+		pairs = append(pairs, [2]string{key, value})
+	}
+	return pairs, nil
+}
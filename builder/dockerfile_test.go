@@ -0,0 +1,97 @@
+package builder
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDockerfile(t *testing.T) {
+	dockerfile := `# syntax comment
+FROM alpine:3.19
+
+run apk add \
+    # comment inside a continuation
+    curl \
+    git
+CMD ["sh", "-c", "echo hi"]
+`
+	instructions, err := parseDockerfile(strings.NewReader(dockerfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []instruction{
+		{cmd: "FROM", args: "alpine:3.19", line: 2},
+		{cmd: "RUN", args: "apk add curl git", line: 4},
+		{cmd: "CMD", args: `["sh", "-c", "echo hi"]`, line: 8},
+	}
+	if len(instructions) != len(expected) {
+		t.Fatalf("expected %d instructions, got %d", len(expected), len(instructions))
+	}
+	for i, inst := range instructions {
+		if *inst != expected[i] {
+			t.Errorf("instruction %d: expected %+v, got %+v", i, expected[i], *inst)
+		}
+	}
+	if command := instructions[1].command(); !reflect.DeepEqual(command, []string{"/bin/sh", "-c", "apk add curl git"}) {
+		t.Errorf("unexpected shell form command %q", command)
+	}
+	if command := instructions[2].command(); !reflect.DeepEqual(command, []string{"sh", "-c", "echo hi"}) {
+		t.Errorf("unexpected exec form command %q", command)
+	}
+
+	if _, err := parseDockerfile(strings.NewReader("FROM alpine\nWORKDIR\n")); err == nil {
+		t.Error("expected error for instruction without arguments")
+	}
+}
+
+func TestShellWords(t *testing.T) {
+	env := map[string]string{"HOME": "/root", "EMPTY": ""}
+	cases := []struct {
+		input    string
+		expected []string
+	}{
+		{`a  b	c`, []string{"a", "b", "c"}},
+		{`"a b" 'c d' e\ f`, []string{"a b", "c d", "e f"}},
+		{`$HOME/bin ${HOME}/lib`, []string{"/root/bin", "/root/lib"}},
+		{`'$HOME' "$HOME" \$HOME`, []string{"$HOME", "/root", "$HOME"}},
+		{`${EMPTY:-default} ${HOME:-default} x${EMPTY:+set} ${HOME:+set}`, []string{"default", "/root", "x", "set"}},
+		{`$MISSING"" $ 100$`, []string{"", "$", "100$"}},
+	}
+	for _, c := range cases {
+		words, err := shellWords(c.input, env)
+		if err != nil {
+			t.Errorf("%s: %v", c.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(words, c.expected) {
+			t.Errorf("%s: expected %q, got %q", c.input, c.expected, words)
+		}
+	}
+	for _, input := range []string{`"unterminated`, `'unterminated`} {
+		if _, err := shellWords(input, env); err == nil {
+			t.Errorf("%s: expected error", input)
+		}
+	}
+}
+
+func TestParseKeyValues(t *testing.T) {
+	env := map[string]string{"VERSION": "1.0"}
+	pairs, err := parseKeyValues(&instruction{cmd: "ENV", args: `A=1 B="x y" C=$VERSION`}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][2]string{{"A", "1"}, {"B", "x y"}, {"C", "1.0"}}; !reflect.DeepEqual(pairs, expected) {
+		t.Errorf("expected %q, got %q", expected, pairs)
+	}
+	pairs, err = parseKeyValues(&instruction{cmd: "ENV", args: "PATH /usr/bin /bin"}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][2]string{{"PATH", "/usr/bin /bin"}}; !reflect.DeepEqual(pairs, expected) {
+		t.Errorf("expected %q, got %q", expected, pairs)
+	}
+	if _, err := parseKeyValues(&instruction{cmd: "LABEL", args: "version 1"}, env); err == nil {
+		t.Error("expected error for LABEL without key=value")
+	}
+}
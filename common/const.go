@@ -2,7 +2,9 @@ package common
 
 const (
 	ImageBaseDir     = "/var/lib/my-container/images/"
+	LayerStoreDir    = "/var/lib/my-container/layers/"
 	TempDir          = "/var/lib/my-container/tmp/"
 	ContainerBaseDir = "/var/run/my-container/containers/"
 	NetNsBaseDir     = "/var/run/my-container/ns/"
+	VolumeDir        = "/var/lib/my-container/volumes/"
 )
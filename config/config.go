@@ -6,7 +6,33 @@ import (
 )
 
 type Config struct {
+	// Registries Docker Hub镜像依次尝试的registry和镜像源
 	Registries []string `json:"Registries"`
+	// RegistryConfigs 每个registry的连接配置，key为registry地址，例如localhost:5000
+	RegistryConfigs map[string]RegistryConfig `json:"RegistryConfigs"`
+	// LayerCompression commit和import创建的layer使用的压缩格式，gzip、zstd或none，默认gzip
+	LayerCompression string `json:"LayerCompression"`
+	// TrustPolicy 拉取和运行镜像时的校验策略
+	TrustPolicy TrustPolicy `json:"TrustPolicy"`
+}
+
+type TrustPolicy struct {
+	// RequireDigest 只允许按digest拉取和运行镜像，例如redis@sha256:...
+	RequireDigest bool `json:"RequireDigest"`
+	// VerifyDigests 运行前校验镜像目录中manifest、config和layer文件的digest，以及解压后的layer目录
+	VerifyDigests bool `json:"VerifyDigests"`
+	// SignedRepositories 必须有cosign签名的仓库和验证签名的公钥文件，
+	// key为仓库名，例如registry.example.com/team/app，以/*结尾时匹配该前缀下的所有仓库
+	SignedRepositories map[string][]string `json:"SignedRepositories"`
+}
+
+type RegistryConfig struct {
+	// Insecure 使用HTTP访问registry
+	Insecure bool `json:"Insecure"`
+	// CAFile 验证registry证书使用的CA证书文件
+	CAFile string `json:"CAFile"`
+	// SkipVerify 不验证registry的证书
+	SkipVerify bool `json:"SkipVerify"`
 }
 
 const confFilePath = "/etc/my-container/config.json"
@@ -23,4 +49,7 @@ func init() {
 	if err := json.Unmarshal(bytes, &GlobalConfig); err != nil {
 		GlobalConfig = defaultConfig
 	}
+	if len(GlobalConfig.Registries) == 0 {
+		GlobalConfig.Registries = defaultConfig.Registries
+	}
 }
@@ -1,24 +1,27 @@
 package container
 
 import (
-	"bufio"
-	"bytes"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"github.com/StellarisJAY/my-container/common"
 	"github.com/StellarisJAY/my-container/image"
 	"github.com/StellarisJAY/my-container/util"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"golang.org/x/sys/unix"
 	"log"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type RunningContainerInfo struct {
 	ContainerId string
 	Image       string
 	Pid         string
+	Status      string
 }
 
 func NewContainerId() string {
@@ -60,25 +63,30 @@ func getRunningContainerInfo(containerId string) *RunningContainerInfo {
 		log.Println("Unable to get pid for ", containerId, " error: ", err)
 		return nil
 	}
-	imageHash, err := getContainerImage(containerId)
+	state, err := GetState(containerId)
 	if err != nil {
-		log.Println("Unable to get image hash, error ", err)
+		log.Println("Unable to get container state, error ", err)
 		return nil
 	}
-	nameAndTag, err := image.GetImageNameAndTagByHash(imageHash)
+	nameAndTag, err := image.GetImageNameAndTagByHash(state.Image)
 	if err != nil {
 		log.Println("Unable to get image name and tag, error: ", err)
 		return nil
 	}
+	status := "Up"
+	if state.Health != nil {
+		status = fmt.Sprintf("Up (%s)", state.Health.Status)
+	}
 	return &RunningContainerInfo{
 		ContainerId: containerId,
 		Pid:         pid,
-		Image:       strings.Join(nameAndTag, ":"),
+		Image:       image.FamiliarReference(nameAndTag[0], nameAndTag[1]),
+		Status:      status,
 	}
 }
 
-// CreateContainer 从一个镜像创建容器，返回容器ID
-func CreateContainer(imageHash string) string {
+// CreateContainer 从一个镜像创建容器，返回容器ID，失败时删除已经创建的容器目录
+func CreateContainer(imageHash string) (string, error) {
 	containerId := NewContainerId()
 	// 创建容器目录
 	containerDirs := []string{
@@ -87,25 +95,128 @@ func CreateContainer(imageHash string) string {
 		path.Join(common.ContainerBaseDir, containerId, "fs", "workdir"),
 		path.Join(common.ContainerBaseDir, containerId, "fs", "layers"),
 	}
-	util.Must(util.CreateDirsIfNotExist(containerDirs), "Unable to make container dirs")
-	// 挂载容器文件系统
-	util.Must(createContainerFS(imageHash, containerId), "Unable to mount image layers ")
-	return containerId
+	if err := util.CreateDirsIfNotExist(containerDirs); err != nil {
+		return "", fmt.Errorf("unable to make container dirs %w", err)
+	}
+	mounted := false
+	err := func() error {
+		// upperdir的根目录是容器的/，需要允许容器中的非root用户访问
+		if err := os.Chmod(containerDirs[1], 0755); err != nil {
+			return err
+		}
+		// 挂载容器文件系统
+		if err := createContainerFS(imageHash, containerId); err != nil {
+			return fmt.Errorf("unable to mount image layers %w", err)
+		}
+		mounted = true
+		// 创建容器的进程就是之后启动并等待容器的supervisor，记录下来让wait可以发现容器启动前进程已经退出
+		startTime, err := processStartTime(os.Getpid())
+		if err != nil {
+			return err
+		}
+		return saveState(&State{
+			ContainerId:         containerId,
+			Image:               imageHash,
+			Status:              StatusCreated,
+			SupervisorPid:       os.Getpid(),
+			SupervisorStartTime: startTime,
+			CreatedAt:           time.Now(),
+		})
+	}()
+	if err != nil {
+		if mounted {
+			_ = UmountContainerFS(containerId)
+		}
+		_ = os.RemoveAll(path.Join(common.ContainerBaseDir, containerId))
+		return "", err
+	}
+	return containerId, nil
+}
+
+// Remove 删除没有在运行的容器的文件系统和状态记录
+func Remove(containerId string) error {
+	state, err := GetState(containerId)
+	if err != nil {
+		return err
+	}
+	if state.Status == StatusRunning {
+		return fmt.Errorf("container %s is running", containerId)
+	}
+	// 文件系统可能已经卸载
+	_ = UmountContainerFS(containerId)
+	if err := os.RemoveAll(path.Join(common.ContainerBaseDir, containerId)); err != nil {
+		return fmt.Errorf("unable to remove container dir %w", err)
+	}
+	return deleteState(containerId)
+}
+
+// ImagesInUse 返回每个镜像被哪些容器使用，容器删除之前它的overlay lowerdir都指向镜像的layers
+func ImagesInUse() (map[string][]string, error) {
+	states, err := ListStates()
+	if err != nil {
+		return nil, err
+	}
+	inUse := make(map[string][]string)
+	for _, state := range states {
+		inUse[state.Image] = append(inUse[state.Image], state.ContainerId)
+	}
+	return inUse, nil
+}
+
+// containerFSDir 返回容器文件系统的目录，rm删除容器目录之后返回错误
+func containerFSDir(containerId string) (string, error) {
+	dir := path.Join(common.ContainerBaseDir, containerId, "fs")
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("filesystem of container %s was removed", containerId)
+	} else if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// Commit 将容器upperdir中的修改提交为新的镜像，返回新镜像的hash
+func Commit(containerId, ref string) (string, error) {
+	state, err := GetState(containerId)
+	if err != nil {
+		return "", err
+	}
+	fsDir, err := containerFSDir(containerId)
+	if err != nil {
+		return "", err
+	}
+	return image.Commit(state.Image, path.Join(fsDir, "upperdir"), ref, "commit from container "+containerId)
+}
+
+// CommitLayer 将容器upperdir中的修改提交为没有tag的新镜像，config和history为新镜像的config和构建记录，
+// 用于build的每一步，返回新镜像的hash
+func CommitLayer(containerId string, config *v1.ConfigFile, history v1.History) (string, error) {
+	state, err := GetState(containerId)
+	if err != nil {
+		return "", err
+	}
+	fsDir, err := containerFSDir(containerId)
+	if err != nil {
+		return "", err
+	}
+	return image.CreateImage(state.Image, path.Join(fsDir, "upperdir"), config, history)
 }
 
 func createContainerFS(imageHash string, containerId string) error {
-	manifest, err := image.ParseManifest(imageHash)
+	// lazy pull的layer在当前进程中通过FUSE挂载，卸载overlay后需要调用image.UnmountLazyLayers
+	layerPaths, err := image.MountLayers(imageHash)
 	if err != nil {
 		return err
 	}
-	imagePath := common.ImageBaseDir + imageHash
-	layers := manifest[0].Layers
-	var layerPaths []string
-	for _, layer := range layers {
-		layerPath := path.Join(imagePath, "layers", strings.TrimSuffix(layer, ".tar.gz")[:16])
-		layerPaths = append(layerPaths, layerPath)
+	// overlay的lowerdir中靠前的目录在上层，与镜像layer的顺序相反
+	lowerDirs := make([]string, 0, len(layerPaths))
+	for i := len(layerPaths) - 1; i >= 0; i-- {
+		lowerDirs = append(lowerDirs, layerPaths[i])
+	}
+	// 没有layer的镜像（例如build时FROM scratch之后只修改了config）使用空目录作为lowerdir
+	if len(lowerDirs) == 0 {
+		lowerDirs = append(lowerDirs, path.Join(common.ContainerBaseDir, containerId, "fs", "layers"))
 	}
-	return mountContainerLayers(containerId, layerPaths)
+	return mountContainerLayers(containerId, lowerDirs)
 }
 
 func mountContainerLayers(containerId string, layers []string) error {
@@ -126,44 +237,25 @@ func UmountContainerFS(containerId string) error {
 	return unix.Unmount(path.Join(common.ContainerBaseDir, containerId, "fs", "mnt"), 0)
 }
 
+// getRunningContainerPid 返回容器中执行的命令的pid。child-mode进程（State.Pid）是容器pid namespace的init，
+// 容器的命令是它的子进程；cgroup.procs中进程的顺序不固定，exec和健康检查的进程也在容器cgroup中，
+// 因此按父进程查找
 func getRunningContainerPid(containerId string) (string, error) {
-	dir := "/sys/fs/cgroup/cpu/my_container/" + containerId
-	if stat, err := os.Stat(dir); os.IsNotExist(err) || !stat.IsDir() {
-		return "", os.ErrNotExist
-	}
-	data, err := os.ReadFile(path.Join(dir, "cgroup.procs"))
+	state, err := GetState(containerId)
 	if err != nil {
 		return "", err
 	}
-	pids := strings.Split(string(data), "\n")
-	return pids[1], nil
-}
-
-func getContainerImage(containerId string) (string, error) {
-	data, err := os.ReadFile("/proc/mounts")
+	if state.Status != StatusRunning {
+		return "", os.ErrNotExist
+	}
+	pids, err := getContainerPids(containerId)
 	if err != nil {
-		return "", fmt.Errorf("can't read /proc/mounts error: %w", err)
+		return "", err
 	}
-	reader := bufio.NewReader(bytes.NewReader(data))
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			break
-		}
-		parts := strings.Split(line, " ")
-		_, target, mountType, mountOptions := parts[0], parts[1], parts[2], parts[3]
-		if mountType != "overlay" || !strings.Contains(target, containerId) {
-			continue
-		}
-		options := strings.Split(mountOptions, ",")
-		for _, opt := range options {
-			if !strings.HasPrefix(opt, "lowerdir=") {
-				continue
-			}
-			lowerDirs := strings.TrimPrefix(opt, "lowerdir=")
-			layer0 := strings.TrimPrefix(lowerDirs, common.ImageBaseDir)
-			return strings.Split(layer0, "/")[0], nil
+	for _, pid := range pids {
+		if fields, err := readProcStat(pid); err == nil && fields[1] == strconv.Itoa(state.Pid) {
+			return pid, nil
 		}
 	}
-	return "", fmt.Errorf("can't find mount points for container %s", containerId)
+	return "", os.ErrNotExist
 }
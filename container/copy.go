@@ -0,0 +1,156 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"github.com/StellarisJAY/my-container/image"
+	"github.com/StellarisJAY/my-container/util"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// containerRoot 返回容器的根目录，运行中的容器通过/proc/{pid}/root进入容器的mount namespace，
+// 没有在运行的容器使用宿主机上overlay的挂载点，release用来卸载临时的挂载
+func containerRoot(containerId string) (string, func(), error) {
+	state, err := GetState(containerId)
+	if err != nil {
+		return "", nil, err
+	}
+	if state.Status == StatusRunning {
+		return path.Join("/proc", strconv.Itoa(state.Pid), "root"), func() {}, nil
+	}
+	return mountedRootfs(state)
+}
+
+// mountedRootfs 返回宿主机上容器overlay的挂载点。已创建还没有运行的容器已经挂载；
+// 已停止的容器退出时卸载了overlay，需要重新挂载
+func mountedRootfs(state *State) (string, func(), error) {
+	fsDir, err := containerFSDir(state.ContainerId)
+	if err != nil {
+		return "", nil, err
+	}
+	mntPath := path.Join(fsDir, "mnt")
+	if state.Status != StatusExited {
+		return mntPath, func() {}, nil
+	}
+	if err := createContainerFS(state.Image, state.ContainerId); err != nil {
+		return "", nil, err
+	}
+	return mntPath, func() {
+		_ = UmountContainerFS(state.ContainerId)
+		image.UnmountLazyLayers()
+	}, nil
+}
+
+// CopyToContainer 将宿主机的src复制到容器中的dest
+func CopyToContainer(containerId, src, dest string) error {
+	if _, err := os.Lstat(src); err != nil {
+		return err
+	}
+	root, release, err := containerRoot(containerId)
+	if err != nil {
+		return err
+	}
+	defer release()
+	srcName := filepath.Base(src)
+	return extractInContainer(root, dest, srcName, func(w io.Writer) error {
+		return util.TarPath(src, srcName, w)
+	})
+}
+
+// ExtractToContainer 将writeTar写出的tar解压到容器的根目录，归档中的路径为容器中的绝对路径，
+// 用于build的COPY和ADD
+func ExtractToContainer(containerId string, writeTar func(w io.Writer) error) error {
+	root, release, err := containerRoot(containerId)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return extractInContainer(root, "/", ".", writeTar)
+}
+
+// extractInContainer 在cp-helper子进程中将writeTar写出的tar解压到容器中的dest
+func extractInContainer(root, dest, name string, writeTar func(w io.Writer) error) error {
+	cmd := exec.Command("/proc/self/exe", "cp-helper", "extract", root, dest, name)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	tarErr := writeTar(stdin)
+	_ = stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("unable to extract archive in container %w", err)
+	}
+	return tarErr
+}
+
+// CopyFromContainer 将容器中的src复制到宿主机的dest
+func CopyFromContainer(containerId, src, dest string) error {
+	// dest为已存在的目录时复制到目录中，否则复制为dest
+	target, name := dest, filepath.Base(src)
+	if info, err := os.Stat(dest); err != nil || !info.IsDir() {
+		target, name = filepath.Dir(dest), filepath.Base(dest)
+	}
+	root, release, err := containerRoot(containerId)
+	if err != nil {
+		return err
+	}
+	defer release()
+	cmd := exec.Command("/proc/self/exe", "cp-helper", "archive", root, src, name)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	extractErr := util.UntarToHost(stdout, target, os.Getuid(), os.Getgid())
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("unable to archive %s in container %w", src, err)
+	}
+	return extractErr
+}
+
+// CopyHelper 在cp-helper子进程中执行，chroot到容器根目录后通过stdin/stdout传输tar，
+// 容器中的符号链接都在容器根目录内解析
+func CopyHelper(args []string) error {
+	if len(args) != 4 {
+		return errors.New("usage: cp-helper archive|extract ROOT PATH NAME")
+	}
+	mode, root, filePath, name := args[0], args[1], args[2], args[3]
+	if err := unix.Chroot(root); err != nil {
+		return fmt.Errorf("unable to chroot to container root %w", err)
+	}
+	if err := unix.Chdir("/"); err != nil {
+		return err
+	}
+	switch mode {
+	case "archive":
+		return util.TarPath(filePath, name, os.Stdout)
+	case "extract":
+		if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+			return util.UntarReader(os.Stdin, filePath, nil)
+		}
+		// 目标不是目录时，归档的根路径改名为目标路径的文件名
+		newName := filepath.Base(filePath)
+		return util.UntarReader(os.Stdin, filepath.Dir(filePath), func(entry string) string {
+			if entry == name || strings.HasPrefix(entry, name+"/") {
+				return newName + strings.TrimPrefix(entry, name)
+			}
+			return entry
+		})
+	default:
+		return fmt.Errorf("unknown cp-helper mode %s", mode)
+	}
+}
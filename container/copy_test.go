@@ -0,0 +1,108 @@
+package container
+
+import (
+	"github.com/StellarisJAY/my-container/common"
+	"github.com/StellarisJAY/my-container/image"
+	"github.com/StellarisJAY/my-container/util"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// TestMain 复制文件时通过/proc/self/exe启动cp-helper子进程，测试二进制需要能执行它
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == "cp-helper" {
+		if err := CopyHelper(os.Args[2:]); err != nil {
+			log.Fatalln(err)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// importTestImage 将只包含给定文件的根文件系统导入为镜像，测试结束后删除
+func importTestImage(t *testing.T, ref string, files map[string]string) string {
+	rootfs := t.TempDir()
+	for name, content := range files {
+		file := filepath.Join(rootfs, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tarFile := filepath.Join(t.TempDir(), "rootfs.tar")
+	f, err := os.Create(tarFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = util.TarRootfs(rootfs, nil, f)
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageHash, err := image.Import(tarFile, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = image.RemoveImage(ref, true, nil)
+	})
+	return imageHash
+}
+
+func TestCopyFromExitedContainer(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must run as root to mount the container overlay")
+	}
+	imageHash := importTestImage(t, "my-container-test/cp:latest", map[string]string{"etc/hostname": "image\n"})
+	containerId, err := CreateContainer(imageHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = Remove(containerId)
+	})
+	mntPath := path.Join(common.ContainerBaseDir, containerId, "fs", "mnt")
+	if err := os.MkdirAll(path.Join(mntPath, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(mntPath, "data", "out.txt"), []byte("written by container\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 和run一样启动并等待容器进程，退出后卸载overlay
+	cmd := exec.Command("true")
+	if err := startContainer(cmd, containerId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := waitContainer(cmd, containerId); err != nil {
+		t.Fatal(err)
+	}
+	if err := UmountContainerFS(containerId); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := t.TempDir()
+	for src, expected := range map[string]string{"/data/out.txt": "written by container\n", "/etc/hostname": "image\n"} {
+		if err := CopyFromContainer(containerId, src, dest); err != nil {
+			t.Fatalf("copy %s from exited container: %v", src, err)
+		}
+		data, err := os.ReadFile(filepath.Join(dest, path.Base(src)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Errorf("%s = %q, expected %q", src, data, expected)
+		}
+	}
+	if err := Remove(containerId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(common.ContainerBaseDir, containerId)); !os.IsNotExist(err) {
+		t.Errorf("container dir not removed by rm: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package container
+
+import (
+	"errors"
+	"github.com/StellarisJAY/my-container/image"
+	"github.com/StellarisJAY/my-container/util"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	ChangeAdd    = "A"
+	ChangeModify = "C"
+	ChangeDelete = "D"
+)
+
+// Change 容器文件系统相对于镜像的一个修改
+type Change struct {
+	Kind string
+	Path string
+}
+
+// Diff 遍历容器的upperdir，列出相对于镜像新增、修改和删除的路径
+func Diff(containerId string) ([]Change, error) {
+	state, err := GetState(containerId)
+	if err != nil {
+		return nil, err
+	}
+	fsDir, err := containerFSDir(containerId)
+	if err != nil {
+		return nil, err
+	}
+	lowerDirs, err := image.MountLayers(state.Image)
+	if err != nil {
+		return nil, err
+	}
+	defer image.UnmountLazyLayers()
+	upperDir := path.Join(fsDir, "upperdir")
+	var changes []Change
+	err = filepath.WalkDir(upperDir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(upperDir, file)
+		if rel == "." {
+			return nil
+		}
+		containerPath := "/" + rel
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if util.IsOverlayWhiteout(info) {
+			changes = append(changes, Change{Kind: ChangeDelete, Path: containerPath})
+			return nil
+		}
+		if !existsInLayers(lowerDirs, rel) {
+			changes = append(changes, Change{Kind: ChangeAdd, Path: containerPath})
+			return nil
+		}
+		changes = append(changes, Change{Kind: ChangeModify, Path: containerPath})
+		// opaque目录隐藏了镜像中该目录的全部内容，upperdir中没有的文件都视为删除
+		if info.IsDir() && util.IsOverlayOpaque(file) {
+			deleted, err := opaqueDeletions(lowerDirs, upperDir, rel)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, deleted...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// existsInLayers 按照overlay合并layer的规则判断rel在镜像中是否存在。layers的顺序为从下到上，
+// 从最上层开始查找，某一层中rel或它的父目录是whiteout、非目录文件或者opaque目录时，下层的文件都被隐藏
+func existsInLayers(layers []string, rel string) bool {
+	for i := len(layers) - 1; i >= 0; i-- {
+		info, err := os.Lstat(filepath.Join(layers[i], rel))
+		if err == nil {
+			return !util.IsOverlayWhiteout(info)
+		}
+		if hiddenByLayer(layers[i], rel) {
+			return false
+		}
+	}
+	return false
+}
+
+// hiddenByLayer rel不在layer中时，判断layer中它的父目录是否隐藏了下层layer中的rel
+func hiddenByLayer(layer, rel string) bool {
+	dir := layer
+	for _, part := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+		if part == "." {
+			break
+		}
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if err != nil {
+			return false
+		}
+		if !info.IsDir() || util.IsOverlayOpaque(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// opaqueDeletions 列出镜像中opaque目录下被隐藏的文件，只包含在镜像中可见的文件
+func opaqueDeletions(lowerDirs []string, upperDir, rel string) ([]Change, error) {
+	seen := make(map[string]bool)
+	var changes []Change
+	for _, layer := range lowerDirs {
+		entries, err := os.ReadDir(filepath.Join(layer, rel))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			name := filepath.Join(rel, entry.Name())
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if !existsInLayers(lowerDirs, name) {
+				continue
+			}
+			if _, err := os.Lstat(filepath.Join(upperDir, name)); errors.Is(err, os.ErrNotExist) {
+				changes = append(changes, Change{Kind: ChangeDelete, Path: "/" + name})
+			}
+		}
+	}
+	return changes, nil
+}
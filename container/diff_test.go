@@ -0,0 +1,91 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"github.com/StellarisJAY/my-container/util"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// buildLayer 将只包含给定文件的OCI layer解压到新的目录，名称以/结尾的为目录
+func buildLayer(t *testing.T, names ...string) string {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, name := range names {
+		header := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}
+		if strings.HasSuffix(name, "/") {
+			header.Typeflag, header.Mode = tar.TypeDir, 0755
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := util.UntarLayer(buf, dir); err != nil {
+		if errors.Is(err, unix.EPERM) || errors.Is(err, unix.ENOTSUP) {
+			t.Skip("not permitted to create overlay whiteouts: ", err)
+		}
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestExistsInLayers(t *testing.T) {
+	layers := []string{
+		buildLayer(t, "a/", "a/deleted", "a/kept", "b/", "b/x", "c/", "c/old", "d/", "d/e/", "d/e/f"),
+		buildLayer(t, "a/", "a/.wh.deleted", ".wh.b", "c/", "c/.wh..wh..opq", "c/new", "d/", "d/.wh..wh..opq", "d/e/"),
+		buildLayer(t, "a/", "a/deleted"),
+	}
+	cases := map[string]bool{
+		"a/kept":    true,
+		"a/deleted": true,
+		"b":         false,
+		"b/x":       false,
+		"c/old":     false,
+		"c/new":     true,
+		"d/e":       true,
+		"d/e/f":     false,
+		"missing":   false,
+	}
+	for rel, expected := range cases {
+		if exists := existsInLayers(layers, rel); exists != expected {
+			t.Errorf("existsInLayers(%s) = %v, expected %v", rel, exists, expected)
+		}
+	}
+	// 最上层没有重新创建的文件被中间层删除
+	if existsInLayers(layers[:2], "a/deleted") {
+		t.Error("a/deleted should be hidden by the whiteout in the second layer")
+	}
+}
+
+func TestOpaqueDeletions(t *testing.T) {
+	layers := []string{
+		buildLayer(t, "etc/", "etc/passwd", "etc/group", "etc/hosts"),
+		buildLayer(t, "etc/", "etc/.wh.group"),
+	}
+	upperDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(upperDir, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(upperDir, "etc", "hosts"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := opaqueDeletions(layers, upperDir, "etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// group在镜像中已经被删除，hosts在upperdir中重新创建
+	expected := []Change{{Kind: ChangeDelete, Path: "/etc/passwd"}}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected %v, got %v", expected, changes)
+	}
+}
@@ -43,6 +43,5 @@ func ExecInContainer(containerId string, args []string) error {
 	mntPath := path.Join(common.ContainerBaseDir, containerId, "fs", "mnt")
 	util.Must(unix.Chroot(mntPath), "Unable to chroot to mnt path")
 	util.Must(unix.Chdir("/"), "Unable to chdir to root dir")
-	util.Must(cmd.Run(), "Unable to exec command")
-	return nil
+	return cmd.Run()
 }
@@ -0,0 +1,49 @@
+package container
+
+import (
+	"bufio"
+	"github.com/StellarisJAY/my-container/util"
+	"io"
+	"os"
+	"strings"
+)
+
+// Export 将容器overlay合并后的根文件系统打包为tar写入w
+func Export(containerId string, w io.Writer) error {
+	state, err := GetState(containerId)
+	if err != nil {
+		return err
+	}
+	root, release, err := mountedRootfs(state)
+	if err != nil {
+		return err
+	}
+	defer release()
+	// 容器中挂载的/proc、/sys和volume不属于容器的文件系统
+	mounts, err := subMounts(root)
+	if err != nil {
+		return err
+	}
+	return util.TarRootfs(root, mounts, w)
+}
+
+// subMounts 列出root之下的所有挂载点
+func subMounts(root string) ([]string, error) {
+	file, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var mounts []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), " ")
+		if len(parts) < 2 {
+			continue
+		}
+		if target := parts[1]; strings.HasPrefix(target, root+"/") {
+			mounts = append(mounts, target)
+		}
+	}
+	return mounts, scanner.Err()
+}
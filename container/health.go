@@ -0,0 +1,170 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/StellarisJAY/my-container/image"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"log"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	HealthStarting  = "starting"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 30 * time.Second
+	defaultHealthRetries  = 3
+	maxHealthOutput       = 4096
+)
+
+// Health 容器健康检查的状态
+type Health struct {
+	Status        string    `json:"Status"`
+	FailingStreak int       `json:"FailingStreak"`
+	LastExitCode  int       `json:"LastExitCode"`
+	LastOutput    string    `json:"LastOutput"`
+	LastCheckAt   time.Time `json:"LastCheckAt"`
+}
+
+// healthConfig 合并镜像的Healthcheck和命令行参数，命令行参数优先；返回nil表示不做健康检查
+func healthConfig(opt *Options, imageHash string) *v1.HealthConfig {
+	hc := &v1.HealthConfig{}
+	if config, err := image.ParseConfig(imageHash); err != nil {
+		log.Println("Unable to read image config: ", err)
+	} else if config.Config.Healthcheck != nil {
+		*hc = *config.Config.Healthcheck
+	}
+	if opt.HealthCmd != "" {
+		hc.Test = []string{"CMD-SHELL", opt.HealthCmd}
+	}
+	if opt.HealthInterval > 0 {
+		hc.Interval = opt.HealthInterval
+	}
+	if opt.HealthTimeout > 0 {
+		hc.Timeout = opt.HealthTimeout
+	}
+	if opt.HealthRetries > 0 {
+		hc.Retries = opt.HealthRetries
+	}
+	if opt.HealthStartPeriod > 0 {
+		hc.StartPeriod = opt.HealthStartPeriod
+	}
+	if len(hc.Test) == 0 || hc.Test[0] == "NONE" {
+		return nil
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = defaultHealthInterval
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = defaultHealthTimeout
+	}
+	if hc.Retries <= 0 {
+		hc.Retries = defaultHealthRetries
+	}
+	return hc
+}
+
+// probeCommand 将Healthcheck的Test转换为容器内执行的命令
+func probeCommand(test []string) []string {
+	switch test[0] {
+	case "CMD":
+		return test[1:]
+	case "CMD-SHELL":
+		return []string{"/bin/sh", "-c", strings.Join(test[1:], " ")}
+	default:
+		return test
+	}
+}
+
+// monitorHealth 周期性地在容器中执行探测命令，直到stop被关闭。
+// StartPeriod内的失败不计入Retries，启动期内第一次成功后启动期结束
+func monitorHealth(containerId string, hc *v1.HealthConfig, stop <-chan struct{}) {
+	err := updateState(containerId, func(state *State) {
+		state.Health = &Health{Status: HealthStarting}
+	})
+	if err != nil {
+		log.Println("Unable to save health status: ", err)
+	}
+	startedAt := time.Now()
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		exitCode, output := runProbe(containerId, hc)
+		inStartPeriod := time.Since(startedAt) < hc.StartPeriod
+		// 探测期间容器可能已经退出，不能在退出状态保存之后再写入探测结果
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		err := updateState(containerId, func(state *State) {
+			if state.Status != StatusRunning {
+				return
+			}
+			if state.Health == nil {
+				state.Health = &Health{Status: HealthStarting}
+			}
+			health := state.Health
+			health.LastExitCode, health.LastOutput, health.LastCheckAt = exitCode, output, time.Now()
+			if exitCode == 0 {
+				health.Status, health.FailingStreak = HealthHealthy, 0
+				return
+			}
+			if inStartPeriod && health.Status == HealthStarting {
+				return
+			}
+			health.FailingStreak++
+			if health.FailingStreak >= hc.Retries {
+				health.Status = HealthUnhealthy
+			}
+		})
+		if err != nil {
+			log.Println("Unable to save health status: ", err)
+		}
+	}
+}
+
+// runProbe 通过exec子命令在容器namespace中执行探测命令，返回退出码和输出
+func runProbe(containerId string, hc *v1.HealthConfig) (int, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+	args := append([]string{"exec", "-container", containerId}, probeCommand(hc.Test)...)
+	cmd := exec.CommandContext(ctx, "/proc/self/exe", args...)
+	// exec进程和它在容器中启动的探测进程属于同一个新的进程组，超时时杀死整个进程组，
+	// 只杀死exec进程的话容器中的探测进程会继续运行
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	err := cmd.Run()
+	out := output.String()
+	if len(out) > maxHealthOutput {
+		out = out[:maxHealthOutput]
+	}
+	if ctx.Err() != nil {
+		return -1, "health check timed out"
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return ExitStatus(exitErr), out
+	} else if err != nil {
+		return -1, err.Error()
+	}
+	return 0, out
+}
@@ -2,8 +2,10 @@ package container
 
 import (
 	"errors"
+	"fmt"
 	"github.com/StellarisJAY/my-container/cgroup"
 	"github.com/StellarisJAY/my-container/common"
+	"github.com/StellarisJAY/my-container/image"
 	"github.com/StellarisJAY/my-container/network"
 	"github.com/StellarisJAY/my-container/util"
 	"github.com/StellarisJAY/my-container/volume"
@@ -15,6 +17,14 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
+)
+
+const (
+	// NetworkBridge 容器使用独立的网络namespace，通过veth连接到宿主机网桥
+	NetworkBridge = "bridge"
+	// NetworkHost 容器使用宿主机的网络namespace，build的RUN使用这种模式
+	NetworkHost = "host"
 )
 
 type Options struct {
@@ -22,21 +32,92 @@ type Options struct {
 	MemLimit int
 	Mount    string
 	Volume   string
+	// Network 网络模式，为空时使用NetworkBridge
+	Network string
+	// Env、WorkingDir和User设置容器中命令的环境变量、工作目录和用户，build的RUN使用镜像config中的值
+	Env        []string
+	WorkingDir string
+	User       string
+
+	HealthCmd      string
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+	HealthRetries  int
+	// HealthStartPeriod 容器启动后的这段时间内健康检查失败不计入HealthRetries
+	HealthStartPeriod time.Duration
 }
 
 // Run 从image创建一个容器运行
 func Run(opt *Options, containerId string, args []string) {
-	// 创建宿主机网桥
-	util.Must(network.SetupBridge(), "Unable to set up bridge")
-	network.InitIptables()
-	// 宿主机与网桥的veth
-	util.Must(network.SetupHostVeth(), "Unable to connect host veth to bridge")
-	// 创建容器网络命名空间
-	util.Must(network.CreateNetworkNamespace(containerId), "Unable to create network namespace")
-	util.Must(network.CreateVeth(containerId), "Unable to create container veth")
-	util.Must(network.SetupVethToBridge(containerId), "Unable to setup container veth to bridge ")
-	prepareVethInNamespace(containerId)
+	if opt.Network != NetworkHost {
+		// 创建宿主机网桥
+		util.Must(network.SetupBridge(), "Unable to set up bridge")
+		network.InitIptables()
+		// 宿主机与网桥的veth
+		util.Must(network.SetupHostVeth(), "Unable to connect host veth to bridge")
+		// 创建容器网络命名空间
+		util.Must(network.CreateNetworkNamespace(containerId), "Unable to create network namespace")
+		util.Must(network.CreateVeth(containerId), "Unable to create container veth")
+		util.Must(network.SetupVethToBridge(containerId), "Unable to setup container veth to bridge ")
+		prepareVethInNamespace(containerId)
+	}
+	originalNS, err := unix.Open("/proc/self/ns/net", unix.O_RDONLY|unix.O_CLOEXEC, 0644)
+	util.Must(err, "Unable to open host netns")
+	defer unix.Close(originalNS)
+
+	cmd := childCommand(opt, containerId, args)
+	log.Println("Cmd Args: ", cmd.Args)
+	// 进入子进程
+	util.Must(startContainer(cmd, containerId), "namespace run failed")
+	stopHealth := make(chan struct{})
+	if state, err := GetState(containerId); err == nil {
+		if hc := healthConfig(opt, state.Image); hc != nil {
+			go monitorHealth(containerId, hc, stopHealth)
+		}
+	}
+	exitCode, err := waitContainer(cmd, containerId)
+	util.Must(err, "namespace run failed")
+	close(stopHealth)
+	// 退出码已经保存，清理失败只记录日志，wait仍然可以得到退出码
+	if err := unix.Setns(originalNS, unix.CLONE_NEWNET); err != nil {
+		log.Println("Unable to switch back to host netns: ", err)
+	}
+	if err := UmountContainerFS(containerId); err != nil {
+		log.Println("Unable to unmount container fs: ", err)
+	}
+	image.UnmountLazyLayers()
+	if opt.Network != NetworkHost {
+		network.UnmountNetworkNamespace(containerId)
+	}
+	if err := cgroup.RemoveCGroups(containerId); err != nil {
+		log.Println("Unable to remove cgroups: ", err)
+	}
+	// 保留容器目录，停止的容器仍然可以cp，使用rm命令删除
+	log.Println("container done, exit code: ", exitCode)
+}
 
+// RunStep 在容器中执行build的一个步骤，返回命令的退出码。和Run不同，build的步骤使用宿主机网络，
+// 不做健康检查，出错时返回错误而不是退出进程，容器的文件系统保留给调用者提交后删除
+func RunStep(opt *Options, containerId string, args []string) (int, error) {
+	stepOpt := *opt
+	stepOpt.Network = NetworkHost
+	cmd := childCommand(&stepOpt, containerId, args)
+	cmd.Stdin = nil
+	if err := startContainer(cmd, containerId); err != nil {
+		return 0, fmt.Errorf("unable to start container %w", err)
+	}
+	exitCode, err := waitContainer(cmd, containerId)
+	if err := UmountContainerFS(containerId); err != nil {
+		log.Println("Unable to unmount container fs: ", err)
+	}
+	if err := cgroup.RemoveCGroups(containerId); err != nil {
+		log.Println("Unable to remove cgroups: ", err)
+	}
+	return exitCode, err
+}
+
+// childCommand 创建以child-mode运行容器命令的子进程
+func childCommand(opt *Options, containerId string, args []string) *exec.Cmd {
 	cmdArgs := []string{"child-mode"}
 	cmdArgs = append(cmdArgs, opt.ToString()...)
 	cmdArgs = append(cmdArgs, "-container", containerId)
@@ -51,59 +132,121 @@ func Run(opt *Options, containerId string, args []string) {
 		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
 			syscall.CLONE_NEWPID | syscall.CLONE_NEWUTS,
 	}
-	originalNS, _ := unix.Open("/proc/self/ns/net", unix.O_RDONLY, 0644)
-	log.Println("Cmd Args: ", cmd.Args)
-	// 进入子进程
-	util.Must(cmd.Run(), "namespace run failed")
-	// 回到父进程
-	util.Must(unix.Setns(originalNS, unix.CLONE_NEWNET), "Unable to switch back to host netns")
-	util.Must(UmountContainerFS(containerId), "Unable to unmount container fs")
-	network.UnmountNetworkNamespace(containerId)
-	util.Must(cgroup.RemoveCGroups(containerId), "Unable to remove cgroups ")
-	util.Must(os.RemoveAll(path.Join(common.ContainerBaseDir, containerId)), "Unable to remove container dir")
-	log.Println("container done")
+	return cmd
+}
+
+// startContainer 启动child-mode进程，记录容器进程。supervisor为创建容器时记录的当前进程，它等待容器退出并保存退出码
+func startContainer(cmd *exec.Cmd, containerId string) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return updateState(containerId, func(state *State) {
+		state.Status, state.Pid = StatusRunning, cmd.Process.Pid
+	})
+}
+
+// waitContainer 等待child-mode进程退出，在清理容器之前立即保存退出码，
+// wait命令通过supervisor进程退出得知容器已停止
+func waitContainer(cmd *exec.Cmd, containerId string) (int, error) {
+	exitCode := 0
+	if err := cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return 0, err
+		}
+		exitCode = ExitStatus(exitErr)
+	}
+	err := updateState(containerId, func(state *State) {
+		state.Status, state.ExitCode, state.FinishedAt = StatusExited, exitCode, time.Now()
+	})
+	if err != nil {
+		return exitCode, fmt.Errorf("unable to save container state %w", err)
+	}
+	return exitCode, nil
 }
 
-// ExecCommand 在一个容器中执行命令，该函数在child-mode子进程中进行，此时进程已经处于新的Namespace
-func ExecCommand(containerId string, options *Options, args []string) {
+// ExitStatus 返回进程的退出码，被信号终止时和shell一样返回128+信号值
+func ExitStatus(exitErr *exec.ExitError) int {
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
+}
+
+// ExecCommand 在一个容器中执行命令，该函数在child-mode子进程中进行，此时进程已经处于新的Namespace，返回命令的退出码
+func ExecCommand(containerId string, options *Options, args []string) int {
 	// 创建CGroup控制CPU和内存配额
 	cgroup.CreateCGroups(containerId)
 	cgroup.ConfigureCGroup(containerId, options.CpuLimit, options.MemLimit)
 
 	// bind mounts
 	var bindMntPoint string
-	if m, err := bindMounts(containerId, options.Mount); err != nil {
-		log.Println("Unable to mount host directory ", err)
-	} else {
-		bindMntPoint = m
+	if options.Mount != "" {
+		if m, err := bindMounts(containerId, options.Mount); err != nil {
+			log.Println("Unable to mount host directory ", err)
+		} else {
+			bindMntPoint = m
+		}
 	}
 	// mount volume
 	var volumeMntPoint string
-	if v, err := mountVolume(containerId, options.Volume); err != nil {
-		log.Fatalln(err)
-		return
-	} else {
-		volumeMntPoint = v
+	if options.Volume != "" {
+		if v, err := mountVolume(containerId, options.Volume); err != nil {
+			log.Fatalln(err)
+			return 1
+		} else {
+			volumeMntPoint = v
+		}
 	}
 
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdout = os.Stdout
-	cmd.Stdin = os.Stdin
-	cmd.Stderr = os.Stderr
 	util.Must(unix.Sethostname([]byte(containerId)), "Unable to set container host name")
-	util.Must(network.JoinNetworkNamespace(containerId), "Unable to switch to container netns")
-	network.SetupLocalhostInterface()
+	if options.Network != NetworkHost {
+		util.Must(network.JoinNetworkNamespace(containerId), "Unable to switch to container netns")
+		network.SetupLocalhostInterface()
+	}
 	// 将当前namespace的根目录设置到容器根目录
 	mntPath := path.Join(common.ContainerBaseDir, containerId, "fs", "mnt")
 	util.Must(unix.Chroot(mntPath), "Unable to chroot to container file system")
 	util.Must(unix.Chdir("/"), "Unable to chdir to container root")
+	if options.WorkingDir != "" {
+		util.Must(os.MkdirAll(options.WorkingDir, 0755), "Unable to create working dir")
+		util.Must(unix.Chdir(options.WorkingDir), "Unable to chdir to working dir")
+	}
+	for _, env := range options.Env {
+		key, value, _ := strings.Cut(env, "=")
+		_ = os.Setenv(key, value)
+	}
+	// chroot并设置环境变量之后再创建命令，在容器中按照容器的PATH查找可执行文件
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	if options.User != "" {
+		credential, err := resolveUser(options.User)
+		if err != nil {
+			log.Println("Unable to set user: ", err)
+			return 1
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+	}
 	_ = util.CreateDirsIfNotExist([]string{"/proc", "/sys"})
 	// 挂载/proc /sys
 	util.Must(unix.Mount("proc", "/proc", "proc", 0, ""), "Unable to mount /proc")
 	util.Must(unix.Mount("sysfs", "/sys", "sysfs", 0, ""), "Unable to mount /sys")
 
-	_ = cmd.Run()
-	network.RemoveVeth(containerId, "-ns")
+	exitCode := 0
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = ExitStatus(exitErr)
+		} else {
+			log.Println("Unable to run command: ", err)
+			exitCode = 127
+		}
+	}
+	if options.Network != NetworkHost {
+		network.RemoveVeth(containerId, "-ns")
+	}
 	if bindMntPoint != "" {
 		unix.Unmount(bindMntPoint, 0)
 	}
@@ -112,6 +255,7 @@ func ExecCommand(containerId string, options *Options, args []string) {
 	}
 	util.Must(unix.Unmount("/proc", 0), "Unable to unmount /proc")
 	util.Must(unix.Unmount("/sys", 0), "Unable to unmount /sys")
+	return exitCode
 }
 
 func bindMounts(containerId string, mntOptions string) (string, error) {
@@ -163,8 +307,21 @@ func prepareVethInNamespace(containerId string) {
 }
 
 func (opt *Options) ToString() []string {
-	return []string{
+	args := []string{
 		"-cpu", strconv.FormatFloat(opt.CpuLimit, 'G', 2, 64),
 		"-mem", strconv.Itoa(opt.MemLimit),
 	}
+	for _, env := range opt.Env {
+		args = append(args, "-e", env)
+	}
+	if opt.WorkingDir != "" {
+		args = append(args, "-workdir", opt.WorkingDir)
+	}
+	if opt.User != "" {
+		args = append(args, "-user", opt.User)
+	}
+	if opt.Network != "" {
+		args = append(args, "-network", opt.Network)
+	}
+	return args
 }
@@ -0,0 +1,156 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/StellarisJAY/my-container/common"
+	"github.com/StellarisJAY/my-container/util"
+	"github.com/boltdb/bolt"
+	"path"
+	"time"
+)
+
+const (
+	StatusCreated = "created"
+	StatusRunning = "running"
+	StatusExited  = "exited"
+)
+
+// State 容器的状态记录，保存在state.db中
+type State struct {
+	ContainerId string `json:"ContainerId"`
+	Image       string `json:"Image"`
+	Status      string `json:"Status"`
+	// Pid child-mode进程的pid，SupervisorPid 创建并运行容器的run（或build）进程的pid
+	Pid           int `json:"Pid"`
+	SupervisorPid int `json:"SupervisorPid"`
+	// SupervisorStartTime supervisor进程的启动时间，用于区分pid被重用后的其他进程
+	SupervisorStartTime uint64    `json:"SupervisorStartTime"`
+	ExitCode            int       `json:"ExitCode"`
+	CreatedAt           time.Time `json:"CreatedAt"`
+	FinishedAt          time.Time `json:"FinishedAt"`
+	Health              *Health   `json:"Health,omitempty"`
+}
+
+const (
+	stateDBFile = common.ContainerBaseDir + "state.db"
+	stateBucket = "state"
+)
+
+var ErrContainerNotFound = errors.New("no such container")
+
+func init() {
+	util.Must(util.CreateDirsIfNotExist([]string{path.Dir(stateDBFile)}), "Unable to create container state dir")
+}
+
+func saveState(state *State) error {
+	db, err := bolt.Open(stateDBFile, 0644, nil)
+	if err != nil {
+		return fmt.Errorf("unable to open state database %w", err)
+	}
+	defer db.Close()
+	data, _ := json.Marshal(state)
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(stateBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(state.ContainerId), data)
+	})
+}
+
+// updateState 在同一个事务中读取并修改容器状态
+func updateState(containerId string, update func(state *State)) error {
+	db, err := bolt.Open(stateDBFile, 0644, nil)
+	if err != nil {
+		return fmt.Errorf("unable to open state database %w", err)
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(stateBucket))
+		if err != nil {
+			return err
+		}
+		data := b.Get([]byte(containerId))
+		if data == nil {
+			return ErrContainerNotFound
+		}
+		var state State
+		if err := json.Unmarshal(data, &state); err != nil {
+			return err
+		}
+		update(&state)
+		data, _ = json.Marshal(&state)
+		return b.Put([]byte(containerId), data)
+	})
+}
+
+// GetState 查询容器的状态记录
+func GetState(containerId string) (*State, error) {
+	db, err := bolt.Open(stateDBFile, 0644, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open state database %w", err)
+	}
+	defer db.Close()
+	var state *State
+	e := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(stateBucket))
+		if b == nil {
+			return nil
+		}
+		data := b.Get([]byte(containerId))
+		if data == nil {
+			return nil
+		}
+		state = &State{}
+		return json.Unmarshal(data, state)
+	})
+	if e != nil {
+		return nil, e
+	}
+	if state == nil {
+		return nil, ErrContainerNotFound
+	}
+	return state, nil
+}
+
+func deleteState(containerId string) error {
+	db, err := bolt.Open(stateDBFile, 0644, nil)
+	if err != nil {
+		return fmt.Errorf("unable to open state database %w", err)
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(stateBucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(containerId))
+	})
+}
+
+// ListStates 列出所有容器的状态记录
+func ListStates() ([]State, error) {
+	db, err := bolt.Open(stateDBFile, 0644, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open state database %w", err)
+	}
+	defer db.Close()
+	var states []State
+	e := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(stateBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, data []byte) error {
+			var state State
+			if err := json.Unmarshal(data, &state); err != nil {
+				return err
+			}
+			states = append(states, state)
+			return nil
+		})
+	})
+	return states, e
+}
@@ -0,0 +1,183 @@
+package container
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/StellarisJAY/my-container/common"
+	"github.com/StellarisJAY/my-container/util"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ProcessInfo 容器中一个进程的信息
+type ProcessInfo struct {
+	User    string
+	Pid     string
+	NsPid   string
+	CpuTime string
+	RSS     string
+	Command string
+}
+
+// clockTicks /proc/{pid}/stat中CPU时间的单位，Linux上USER_HZ固定为100
+const clockTicks = 100
+
+// getContainerPids 读取容器cgroup中的所有进程
+func getContainerPids(containerId string) ([]string, error) {
+	dir := "/sys/fs/cgroup/cpu/my_container/" + containerId
+	if stat, err := os.Stat(dir); os.IsNotExist(err) || !stat.IsDir() {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(path.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+	var pids []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			pids = append(pids, line)
+		}
+	}
+	return pids, nil
+}
+
+// Top 列出容器cgroup中所有进程的信息
+func Top(containerId string) ([]ProcessInfo, error) {
+	pids, err := getContainerPids(containerId)
+	if err != nil {
+		return nil, err
+	}
+	rootfs := path.Join(common.ContainerBaseDir, containerId, "fs", "mnt")
+	var processes []ProcessInfo
+	for _, pid := range pids {
+		info, err := getProcessInfo(rootfs, pid)
+		if errors.Is(err, os.ErrNotExist) {
+			// 进程已经退出
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		processes = append(processes, *info)
+	}
+	return processes, nil
+}
+
+// TopWithPsOptions 使用宿主机的ps命令输出，只保留属于容器的进程
+func TopWithPsOptions(containerId string, psOptions []string) (string, error) {
+	pids, err := getContainerPids(containerId)
+	if err != nil {
+		return "", err
+	}
+	output, err := exec.Command("ps", psOptions...).Output()
+	if err != nil {
+		return "", fmt.Errorf("ps error %w", err)
+	}
+	lines := strings.Split(strings.TrimRight(string(output), "\n"), "\n")
+	pidColumn := -1
+	for i, field := range strings.Fields(lines[0]) {
+		if field == "PID" {
+			pidColumn = i
+			break
+		}
+	}
+	if pidColumn == -1 {
+		return "", errors.New("couldn't find PID field in ps output")
+	}
+	containerPids := make(map[string]bool)
+	for _, pid := range pids {
+		containerPids[pid] = true
+	}
+	result := &bytes.Buffer{}
+	result.WriteString(lines[0] + "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) > pidColumn && containerPids[fields[pidColumn]] {
+			result.WriteString(line + "\n")
+		}
+	}
+	return result.String(), nil
+}
+
+// getProcessInfo 读取进程的信息，用户名在容器根目录rootfs的/etc/passwd中查找
+func getProcessInfo(rootfs, pid string) (*ProcessInfo, error) {
+	procDir := path.Join("/proc", pid)
+	status, err := os.ReadFile(path.Join(procDir, "status"))
+	if err != nil {
+		return nil, err
+	}
+	info := &ProcessInfo{Pid: pid, NsPid: pid, RSS: "0"}
+	for _, line := range strings.Split(string(status), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		switch key {
+		case "Uid":
+			info.User = lookupUser(rootfs, fields[0])
+		case "NSpid":
+			// NSpid的最后一项是进程在自己pid namespace中的pid
+			info.NsPid = fields[len(fields)-1]
+		case "VmRSS":
+			info.RSS = fields[0]
+		}
+	}
+	stat, err := readProcStat(pid)
+	if err != nil {
+		return nil, err
+	}
+	info.CpuTime = parseCpuTime(stat)
+	cmdline, err := os.ReadFile(path.Join(procDir, "cmdline"))
+	if err != nil {
+		return nil, err
+	}
+	info.Command = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	if info.Command == "" {
+		comm, _ := os.ReadFile(path.Join(procDir, "comm"))
+		info.Command = "[" + strings.TrimSpace(string(comm)) + "]"
+	}
+	return info, nil
+}
+
+// readProcStat 读取/proc/{pid}/stat中comm之后的字段，第一个字段为进程状态，第二个为父进程pid
+func readProcStat(pid string) ([]string, error) {
+	data, err := os.ReadFile(path.Join("/proc", pid, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	// comm字段可能包含空格，从最后一个')'之后开始解析
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("unexpected format of /proc/%s/stat", pid)
+	}
+	return fields, nil
+}
+
+// parseCpuTime 从/proc/{pid}/stat中计算utime+stime，格式化为hh:mm:ss
+func parseCpuTime(fields []string) string {
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	seconds := (utime + stime) / clockTicks
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+// lookupUser 在容器的/etc/passwd中查找uid对应的用户名，容器和宿主机的用户可能不同；找不到时返回uid
+func lookupUser(rootfs, uid string) string {
+	// 容器中的/etc/passwd可能是指向宿主机文件的符号链接，在容器根目录内解析
+	passwd, err := util.SecureJoin(rootfs, "/etc/passwd")
+	if err != nil {
+		return uid
+	}
+	if fields, err := findEntry(passwd, uid); err == nil && fields[2] == uid {
+		return fields[0]
+	}
+	return uid
+}
@@ -0,0 +1,60 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// resolveUser 解析USER指令格式的user[:group]，用户名和组名在当前根目录的/etc/passwd和/etc/group中查找，
+// 需要在chroot之后调用。没有指定组时使用passwd中用户的组
+func resolveUser(spec string) (*syscall.Credential, error) {
+	userName, groupName, hasGroup := strings.Cut(spec, ":")
+	var uid, gid uint64
+	// passwd的字段为name:password:uid:gid:...
+	if fields, err := findEntry("/etc/passwd", userName); err == nil {
+		uid, _ = strconv.ParseUint(fields[2], 10, 32)
+		gid, _ = strconv.ParseUint(fields[3], 10, 32)
+	} else if uid, err = strconv.ParseUint(userName, 10, 32); err != nil {
+		return nil, fmt.Errorf("unable to find user %s", userName)
+	}
+	if hasGroup {
+		// group的字段为name:password:gid:members
+		if fields, err := findEntry("/etc/group", groupName); err == nil {
+			gid, _ = strconv.ParseUint(fields[2], 10, 32)
+		} else if gid, err = strconv.ParseUint(groupName, 10, 32); err != nil {
+			return nil, fmt.Errorf("unable to find group %s", groupName)
+		}
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// findEntry 在passwd或group格式的文件中查找名称或id为key的记录，数字的key只匹配id，否则只匹配名称
+func findEntry(file, key string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	field := 0
+	if _, err := strconv.ParseUint(key, 10, 32); err == nil {
+		field = 2
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 4 {
+			continue
+		}
+		if fields[field] == key {
+			return fields, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, os.ErrNotExist
+}
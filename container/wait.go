@@ -0,0 +1,70 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"strconv"
+)
+
+// Wait 阻塞直到容器停止，返回容器的退出码。容器已创建但还没有启动时等待它启动后再停止
+func Wait(containerId string) (int, error) {
+	state, err := GetState(containerId)
+	if err != nil {
+		return 0, err
+	}
+	// supervisor在创建容器时记录，保存退出码之后才会退出，created和running状态都通过pidfd等待它退出，不需要轮询。
+	// 容器启动前supervisor就退出了（比如被SIGKILL），状态会停留在created，下面返回错误而不是一直等待
+	if state.Status == StatusCreated || state.Status == StatusRunning {
+		if err := waitSupervisorExit(state); err != nil {
+			return 0, err
+		}
+		if state, err = GetState(containerId); err != nil {
+			return 0, err
+		}
+	}
+	if state.Status != StatusExited {
+		return 0, fmt.Errorf("container %s is %s but its supervisor process is gone", containerId, state.Status)
+	}
+	return state.ExitCode, nil
+}
+
+// waitSupervisorExit 等待容器的supervisor进程退出。pid可能已经被其他进程重用，
+// 打开pidfd之后比较进程的启动时间，不一致说明supervisor已经退出
+func waitSupervisorExit(state *State) error {
+	// 旧版本创建的容器没有记录supervisor
+	if state.SupervisorPid == 0 {
+		return nil
+	}
+	fd, err := unix.PidfdOpen(state.SupervisorPid, 0)
+	if errors.Is(err, unix.ESRCH) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("pidfd_open error %w", err)
+	}
+	defer unix.Close(fd)
+	// pidfd指向打开时的进程，之后pid再被重用也不影响，只需要在打开之后检查一次
+	if startTime, err := processStartTime(state.SupervisorPid); err != nil || startTime != state.SupervisorStartTime {
+		return nil
+	}
+	// 进程退出时pidfd变为可读
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for {
+		if _, err := unix.Poll(fds, -1); err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			return fmt.Errorf("poll pidfd error %w", err)
+		}
+		return nil
+	}
+}
+
+// processStartTime 读取/proc/{pid}/stat中进程的启动时间（系统启动后的clock ticks）
+func processStartTime(pid int) (uint64, error) {
+	fields, err := readProcStat(strconv.Itoa(pid))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
@@ -4,25 +4,26 @@ go 1.21.3
 
 require (
 	github.com/boltdb/bolt v1.3.1
+	github.com/containerd/stargz-snapshotter/estargz v0.14.3
+	github.com/docker/cli v24.0.0+incompatible
 	github.com/google/go-containerregistry v0.16.1
-	golang.org/x/sys v0.13.0
+	github.com/hanwen/go-fuse/v2 v2.9.0
+	github.com/klauspost/compress v1.16.5
+	github.com/opencontainers/go-digest v1.0.0
+	github.com/vishvananda/netlink v1.1.0
+	golang.org/x/sys v0.28.0
 )
 
 require (
-	github.com/containerd/stargz-snapshotter/estargz v0.14.3 // indirect
-	github.com/docker/cli v24.0.0+incompatible // indirect
 	github.com/docker/distribution v2.8.2+incompatible // indirect
 	github.com/docker/docker v24.0.0+incompatible // indirect
 	github.com/docker/docker-credential-helpers v0.7.0 // indirect
-	github.com/klauspost/compress v1.16.5 // indirect
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
-	github.com/opencontainers/go-digest v1.0.0 // indirect
 	github.com/opencontainers/image-spec v1.1.0-rc3 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/sirupsen/logrus v1.9.3 // indirect
 	github.com/stretchr/testify v1.8.4 // indirect
 	github.com/vbatts/tar-split v0.11.3 // indirect
-	github.com/vishvananda/netlink v1.1.0 // indirect
 	github.com/vishvananda/netns v0.0.0-20191106174202-0a2b9b5464df // indirect
-	golang.org/x/sync v0.3.0 // indirect
+	golang.org/x/sync v0.10.0 // indirect
 )
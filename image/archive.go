@@ -0,0 +1,511 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/StellarisJAY/my-container/common"
+	"github.com/StellarisJAY/my-container/util"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	FormatDocker = "docker"
+	FormatOCI    = "oci"
+
+	// ociRefNameAnnotation OCI image-layout中记录镜像tag的annotation
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+	// containerdNameAnnotation containerd和docker导出OCI格式时记录完整镜像名的annotation
+	containerdNameAnnotation = "io.containerd.image.name"
+)
+
+// diskImage 从镜像目录中的manifest.json、config和layer文件重建v1.Image
+type diskImage struct {
+	imagePath string
+	manifest  Manifest
+	rawConfig []byte
+	// rawManifest pull或load时保存的原始manifest，本地commit和build的镜像也会保存重建的manifest
+	rawManifest []byte
+}
+
+type diskLayer struct {
+	file        string
+	digest      v1.Hash
+	compression util.Compression
+	oci         bool
+	// mediaType 原始manifest中记录的类型，为空时根据压缩格式判断
+	mediaType types.MediaType
+}
+
+// LoadImage 根据镜像hash从镜像目录中读取镜像
+func LoadImage(imageHash string) (v1.Image, error) {
+	return loadImageFromPath(common.ImageBaseDir + imageHash)
+}
+
+func loadImageFromPath(imagePath string) (v1.Image, error) {
+	data, err := os.ReadFile(path.Join(imagePath, "manifest.json"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read manifest.json %w", err)
+	}
+	var manifest []Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("unable to parse manifest.json %w", err)
+	}
+	rawConfig, err := os.ReadFile(path.Join(imagePath, manifest[0].Config))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read image config %w", err)
+	}
+	// 旧版本pull的镜像和正在commit的镜像没有原始manifest
+	rawManifest, err := os.ReadFile(path.Join(imagePath, rawManifestFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to read raw manifest %w", err)
+	}
+	return partial.CompressedToImage(&diskImage{
+		imagePath:   imagePath,
+		manifest:    manifest[0],
+		rawConfig:   rawConfig,
+		rawManifest: rawManifest,
+	})
+}
+
+func (d *diskImage) RawConfigFile() ([]byte, error) {
+	return d.rawConfig, nil
+}
+
+func (d *diskImage) MediaType() (types.MediaType, error) {
+	if d.rawManifest != nil {
+		manifest, err := d.storedManifest()
+		if err != nil {
+			return "", err
+		}
+		return manifest.MediaType, nil
+	}
+	if d.oci() {
+		return types.OCIManifestSchema1, nil
+	}
+	return types.DockerManifestSchema2, nil
+}
+
+// oci Docker的manifest不支持zstd压缩的layer，包含zstd layer的镜像使用OCI格式的manifest
+func (d *diskImage) oci() bool {
+	for _, layer := range d.manifest.Layers {
+		if _, compression := splitLayerFile(layer); compression == util.Zstd {
+			return true
+		}
+	}
+	return false
+}
+
+// storedManifest 解析保存的原始manifest
+func (d *diskImage) storedManifest() (*v1.Manifest, error) {
+	manifest, err := v1.ParseManifest(bytes.NewReader(d.rawManifest))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse raw manifest %w", err)
+	}
+	return manifest, nil
+}
+
+// RawManifest 优先返回保存的原始manifest，保证push和save后digest、签名和annotation不变
+func (d *diskImage) RawManifest() ([]byte, error) {
+	if d.rawManifest != nil {
+		return d.rawManifest, nil
+	}
+	configDigest, configSize, err := v1.SHA256(bytes.NewReader(d.rawConfig))
+	if err != nil {
+		return nil, err
+	}
+	manifestType, _ := d.MediaType()
+	configType := types.DockerConfigJSON
+	if d.oci() {
+		configType = types.OCIConfigJSON
+	}
+	manifest := v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     manifestType,
+		Config: v1.Descriptor{
+			MediaType: configType,
+			Size:      configSize,
+			Digest:    configDigest,
+		},
+	}
+	for _, layer := range d.manifest.Layers {
+		l, err := d.layer(layer)
+		if err != nil {
+			return nil, err
+		}
+		size, err := l.Size()
+		if err != nil {
+			return nil, err
+		}
+		mediaType, err := l.MediaType()
+		if err != nil {
+			return nil, err
+		}
+		manifest.Layers = append(manifest.Layers, v1.Descriptor{
+			MediaType: mediaType,
+			Size:      size,
+			Digest:    l.digest,
+		})
+	}
+	return json.Marshal(&manifest)
+}
+
+func (d *diskImage) LayerByDigest(hash v1.Hash) (partial.CompressedLayer, error) {
+	for _, layer := range d.manifest.Layers {
+		if l, err := d.layer(layer); err == nil && l.digest == hash {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("layer %s not found", hash)
+}
+
+// layer 镜像目录中的layer文件以压缩后内容的sha256命名，后缀表示压缩格式
+func (d *diskImage) layer(layer string) (*diskLayer, error) {
+	hex, compression := splitLayerFile(layer)
+	digest, err := v1.NewHash("sha256:" + hex)
+	if err != nil {
+		return nil, err
+	}
+	l := &diskLayer{file: path.Join(d.imagePath, layer), digest: digest, compression: compression, oci: d.oci()}
+	if d.rawManifest != nil {
+		manifest, err := d.storedManifest()
+		if err != nil {
+			return nil, err
+		}
+		for _, desc := range manifest.Layers {
+			if desc.Digest == digest {
+				l.mediaType = desc.MediaType
+				break
+			}
+		}
+	}
+	return l, nil
+}
+
+// splitLayerFile 将layer文件名拆分为digest和压缩格式
+func splitLayerFile(layer string) (string, util.Compression) {
+	for _, compression := range []util.Compression{util.Gzip, util.Zstd, util.Uncompressed} {
+		if strings.HasSuffix(layer, compression.Extension()) {
+			return strings.TrimSuffix(layer, compression.Extension()), compression
+		}
+	}
+	return layer, util.Gzip
+}
+
+func (l *diskLayer) Digest() (v1.Hash, error) {
+	return l.digest, nil
+}
+
+// Compressed lazy pull的layer没有layer文件，从blob缓存读取，未下载的部分从registry下载
+func (l *diskLayer) Compressed() (io.ReadCloser, error) {
+	file, err := os.Open(l.file)
+	if os.IsNotExist(err) {
+		rc, _, lazyErr := openLazyBlob(l.digest)
+		if lazyErr == nil {
+			return rc, nil
+		}
+	}
+	return file, err
+}
+
+func (l *diskLayer) Size() (int64, error) {
+	info, err := os.Stat(l.file)
+	if os.IsNotExist(err) {
+		if lazy, lazyErr := readLazyLayer(l.digest); lazyErr == nil {
+			return lazy.Size, nil
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (l *diskLayer) MediaType() (types.MediaType, error) {
+	if l.mediaType != "" {
+		return l.mediaType, nil
+	}
+	switch {
+	case l.compression == util.Zstd:
+		return types.OCILayerZStd, nil
+	case l.compression == util.Uncompressed && l.oci:
+		return types.OCIUncompressedLayer, nil
+	case l.compression == util.Uncompressed:
+		return types.DockerUncompressedLayer, nil
+	case l.oci:
+		return types.OCILayer, nil
+	default:
+		return types.DockerLayer, nil
+	}
+}
+
+// Save 将多个镜像保存为docker-archive或OCI image-layout格式的tar包。
+// OCI格式保存镜像的原始manifest，load后digest不变；docker-archive格式不包含manifest，load时会重建。
+// docker-archive只能记录tag，按digest引用的镜像只能保存为OCI格式
+func Save(refs []string, format string, w io.Writer) error {
+	images := make(map[name.Reference]v1.Image)
+	for _, src := range refs {
+		ref, err := parseReference(src)
+		if err != nil {
+			return err
+		}
+		if _, ok := ref.(name.Digest); ok && format == FormatDocker {
+			return fmt.Errorf("docker archive cannot record digest reference %s, use -format oci or save it by tag", src)
+		}
+		ok, imageHash := checkImageExistByName(repositoryName(ref.Context()), ref.Identifier())
+		if !ok {
+			return fmt.Errorf("no such image %s", src)
+		}
+		image, err := LoadImage(imageHash)
+		if err != nil {
+			return err
+		}
+		images[ref] = image
+	}
+	switch format {
+	case FormatDocker:
+		return tarball.MultiRefWrite(images, w)
+	case FormatOCI:
+		return saveOCILayout(images, w)
+	default:
+		return fmt.Errorf("unsupported archive format %s", format)
+	}
+}
+
+func saveOCILayout(images map[name.Reference]v1.Image, w io.Writer) error {
+	_ = util.CreateDirsIfNotExist([]string{common.TempDir})
+	dir, err := os.MkdirTemp(common.TempDir, "oci-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		return err
+	}
+	for ref, image := range images {
+		annotations := map[string]string{
+			ociRefNameAnnotation:     ref.Identifier(),
+			containerdNameAnnotation: ref.Name(),
+		}
+		if err := p.AppendImage(image, layout.WithAnnotations(annotations)); err != nil {
+			return err
+		}
+	}
+	return util.TarRootfs(dir, nil, w)
+}
+
+// Load 从docker-archive或OCI image-layout格式的tar包加载镜像，和pull一样保存镜像并记录到数据库。
+// tar包可以用gzip或zstd压缩。
+// OCI格式的多平台镜像选择满足platform的镜像，platform为空时选择当前平台
+func Load(tarFile string, platform string) error {
+	format, err := detectArchiveFormat(tarFile)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case FormatDocker:
+		return loadDockerArchive(tarFile)
+	default:
+		p, err := ParsePlatform(platform)
+		if err != nil {
+			return err
+		}
+		return loadOCILayout(tarFile, p)
+	}
+}
+
+// detectArchiveFormat 根据tar包中是否有oci-layout文件判断格式
+func detectArchiveFormat(tarFile string) (string, error) {
+	file, err := openArchive(tarFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	reader := tar.NewReader(file)
+	format := ""
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		switch path.Clean(header.Name) {
+		case "oci-layout":
+			return FormatOCI, nil
+		case "manifest.json":
+			format = FormatDocker
+		}
+	}
+	if format == "" {
+		return "", errors.New("neither manifest.json nor oci-layout found in archive")
+	}
+	return format, nil
+}
+
+// archiveReader 解压后的tar包，Close时同时关闭解压器和文件
+type archiveReader struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (r *archiveReader) Close() error {
+	_ = r.ReadCloser.Close()
+	return r.file.Close()
+}
+
+// openArchive 打开tar包，gzip或zstd压缩的tar包自动解压
+func openArchive(tarFile string) (io.ReadCloser, error) {
+	file, err := os.Open(tarFile)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := util.DecompressReader(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &archiveReader{ReadCloser: r, file: file}, nil
+}
+
+func loadDockerArchive(tarFile string) error {
+	// tarball每次读取文件都重新打开tar包，压缩的tar包每次都从头解压
+	opener := func() (io.ReadCloser, error) {
+		return openArchive(tarFile)
+	}
+	manifest, err := tarball.LoadManifest(opener)
+	if err != nil {
+		return err
+	}
+	loaded := 0
+	for _, descriptor := range manifest {
+		if len(descriptor.RepoTags) == 0 {
+			// tarball只能按tag选择镜像，没有tag时要求tar包中只有这一个镜像
+			if len(manifest) > 1 {
+				log.Println("Skip untagged image in a multi-image archive ", descriptor.Config)
+				continue
+			}
+			image, err := tarball.Image(opener, nil)
+			if err != nil {
+				return err
+			}
+			if err := loadImage(image, ""); err != nil {
+				return err
+			}
+			loaded++
+			continue
+		}
+		for _, repoTag := range descriptor.RepoTags {
+			t, err := name.NewTag(repoTag)
+			if err != nil {
+				return err
+			}
+			image, err := tarball.Image(opener, &t)
+			if err != nil {
+				return err
+			}
+			if err := loadImage(image, repoTag); err != nil {
+				return err
+			}
+		}
+		loaded++
+	}
+	if loaded == 0 {
+		return errors.New("no image loaded from archive")
+	}
+	return nil
+}
+
+func loadOCILayout(tarFile string, platform *v1.Platform) error {
+	_ = util.CreateDirsIfNotExist([]string{common.TempDir})
+	dir, err := os.MkdirTemp(common.TempDir, "oci-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := util.Untar(tarFile, dir); err != nil {
+		return err
+	}
+	index, err := layout.ImageIndexFromPath(dir)
+	if err != nil {
+		return err
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return err
+	}
+	if len(indexManifest.Manifests) == 0 {
+		return errors.New("no image loaded from archive")
+	}
+	for _, descriptor := range indexManifest.Manifests {
+		repoTag := ociRepoTag(descriptor.Annotations)
+		image, err := ociImage(index, descriptor, platform)
+		if err != nil {
+			return err
+		}
+		if err := loadImage(image, repoTag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ociRepoTag 优先使用完整镜像名，ref.name可能只有tag
+func ociRepoTag(annotations map[string]string) string {
+	if fullName := annotations[containerdNameAnnotation]; fullName != "" {
+		return fullName
+	}
+	refName := annotations[ociRefNameAnnotation]
+	if strings.ContainsAny(refName, ":/") {
+		return refName
+	}
+	return ""
+}
+
+// ociImage 描述符指向镜像索引时选择满足平台要求的镜像，和pull一样比较variant
+func ociImage(index v1.ImageIndex, descriptor v1.Descriptor, platform *v1.Platform) (v1.Image, error) {
+	if !descriptor.MediaType.IsIndex() {
+		return index.Image(descriptor.Digest)
+	}
+	child, err := index.ImageIndex(descriptor.Digest)
+	if err != nil {
+		return nil, err
+	}
+	return selectIndexPlatform(child, platform)
+}
+
+// loadImage 保存加载的镜像，repoTag为空时保存为没有tag的镜像
+func loadImage(image v1.Image, repoTag string) error {
+	if repoTag == "" {
+		imageHash, err := storeV1Image(image, "", "", nil, newPullProgress(false))
+		if err != nil {
+			return err
+		}
+		log.Printf("Loaded untagged image, hash: %s", imageHash)
+		return nil
+	}
+	imageName, tag, err := normalizeReference(repoTag)
+	if err != nil {
+		return err
+	}
+	imageHash, err := storeV1Image(image, imageName, tag, nil, newPullProgress(false))
+	if err != nil {
+		return err
+	}
+	log.Printf("Loaded image %s, hash: %s", FamiliarReference(imageName, tag), imageHash)
+	return nil
+}
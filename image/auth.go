@@ -0,0 +1,100 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"log"
+	"net/http"
+	"os"
+)
+
+// Login 验证registry的用户名和密码，保存到docker的config.json，配置了credential helper时保存到helper中
+func Login(registry, username, password string) error {
+	reg, err := parseRegistry(registry)
+	if err != nil {
+		return err
+	}
+	if err := checkLogin(reg, username, password); err != nil {
+		return err
+	}
+	cf, err := dockerconfig.Load(os.Getenv("DOCKER_CONFIG"))
+	if err != nil {
+		return err
+	}
+	key := authKey(reg)
+	err = cf.GetCredentialsStore(key).Store(types.AuthConfig{
+		Username:      username,
+		Password:      password,
+		ServerAddress: key,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to store credentials %w", err)
+	}
+	log.Println("Login succeeded: ", reg.RegistryStr())
+	return nil
+}
+
+// Logout 删除保存的registry认证信息
+func Logout(registry string) error {
+	reg, err := parseRegistry(registry)
+	if err != nil {
+		return err
+	}
+	cf, err := dockerconfig.Load(os.Getenv("DOCKER_CONFIG"))
+	if err != nil {
+		return err
+	}
+	key := authKey(reg)
+	if err := cf.GetCredentialsStore(key).Erase(key); err != nil {
+		return fmt.Errorf("unable to remove credentials %w", err)
+	}
+	log.Println("Removed login credentials for ", reg.RegistryStr())
+	return nil
+}
+
+// parseRegistry 解析registry地址，为空时使用Docker Hub
+func parseRegistry(registry string) (name.Registry, error) {
+	if registry == "" {
+		registry = name.DefaultRegistry
+	}
+	var opts []name.Option
+	if registryConfig(registry).Insecure {
+		opts = append(opts, name.Insecure)
+	}
+	return name.NewRegistry(registry, opts...)
+}
+
+// authKey 返回registry在config.json中的key，和docker一样Docker Hub使用https://index.docker.io/v1/
+func authKey(reg name.Registry) string {
+	if reg.RegistryStr() == name.DefaultRegistry {
+		return authn.DefaultAuthKey
+	}
+	return reg.RegistryStr()
+}
+
+// checkLogin 使用用户名和密码访问registry的/v2/接口，token认证的registry在获取token时验证
+func checkLogin(reg name.Registry, username, password string) error {
+	base, err := registryTransport(reg.RegistryStr())
+	if err != nil {
+		return err
+	}
+	auth := authn.FromConfig(authn.AuthConfig{Username: username, Password: password})
+	t, err := transport.NewWithContext(context.Background(), reg, auth, base, nil)
+	if err != nil {
+		return fmt.Errorf("login to %s failed %w", reg.RegistryStr(), err)
+	}
+	resp, err := (&http.Client{Transport: t}).Get(fmt.Sprintf("%s://%s/v2/", reg.Scheme(), reg.RegistryStr()))
+	if err != nil {
+		return fmt.Errorf("login to %s failed %w", reg.RegistryStr(), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("login to %s failed: %s", reg.RegistryStr(), resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/StellarisJAY/my-container/common"
+	"github.com/StellarisJAY/my-container/config"
+	"github.com/StellarisJAY/my-container/util"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// Commit 将容器的upperdir打包为新的layer，在基础镜像上创建新镜像，返回新镜像的hash
+func Commit(baseHash, upperDir, ref, comment string) (string, error) {
+	imageName, tag, err := normalizeTag(ref)
+	if err != nil {
+		return "", err
+	}
+	config, err := ParseConfig(baseHash)
+	if err != nil {
+		return "", err
+	}
+	history := v1.History{CreatedBy: "my-container commit", Comment: comment}
+	imageHash, err := createImage(baseHash, upperDir, config, history, joinReference(imageName, tag))
+	if err != nil {
+		return "", err
+	}
+	if err := storeImageMetadata(imageName, tag, imageHash, configPlatform(config)); err != nil {
+		return "", err
+	}
+	return imageHash, nil
+}
+
+// CreateImage 将dir打包为新的layer添加到基础镜像上，创建没有tag的镜像，用于build的每一步。
+// baseHash为空时从空镜像开始；dir为空时只修改config，history记录为empty layer
+func CreateImage(baseHash, dir string, config *v1.ConfigFile, history v1.History) (string, error) {
+	return createImage(baseHash, dir, config, history, "")
+}
+
+func createImage(baseHash, dir string, config *v1.ConfigFile, history v1.History, repoTag string) (string, error) {
+	var baseLayers []string
+	if baseHash != "" {
+		if err := CheckFullyPulled(baseHash); err != nil {
+			return "", err
+		}
+		manifest, err := ParseManifest(baseHash)
+		if err != nil {
+			return "", err
+		}
+		baseLayers = manifest[0].Layers
+	}
+	now := v1.Time{Time: time.Now().UTC()}
+	config.Created, history.Created = now, now
+	layerFile := ""
+	if dir != "" {
+		file, diffID, err := createLayer(dir)
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(file)
+		layerFile = file
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+	} else {
+		history.EmptyLayer = true
+	}
+	config.History = append(config.History, history)
+	return writeImage(baseHash, baseLayers, layerFile, config, repoTag)
+}
+
+// createLayer 将目录打包为layer，文件名为压缩后内容的sha256，同时返回未压缩内容的diffID
+func createLayer(dir string) (string, v1.Hash, error) {
+	return writeLayer(func(w io.Writer) error {
+		return util.TarLayer(dir, w)
+	})
+}
+
+// writeLayer 将writeTar写出的tar按照配置的LayerCompression压缩为layer文件
+func writeLayer(writeTar func(w io.Writer) error) (string, v1.Hash, error) {
+	compression, err := util.ParseCompression(config.GlobalConfig.LayerCompression)
+	if err != nil {
+		return "", v1.Hash{}, err
+	}
+	_ = util.CreateDirsIfNotExist([]string{common.TempDir})
+	tmp, err := os.CreateTemp(common.TempDir, "layer-*"+compression.Extension())
+	if err != nil {
+		return "", v1.Hash{}, err
+	}
+	defer tmp.Close()
+	compressedHash, diffHash := sha256.New(), sha256.New()
+	cw, err := util.CompressWriter(io.MultiWriter(tmp, compressedHash), compression)
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", v1.Hash{}, err
+	}
+	if err := writeTar(io.MultiWriter(cw, diffHash)); err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", v1.Hash{}, fmt.Errorf("unable to pack layer %w", err)
+	}
+	if err := cw.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", v1.Hash{}, err
+	}
+	layerFile := path.Join(common.TempDir, hex.EncodeToString(compressedHash.Sum(nil))+compression.Extension())
+	if err := os.Rename(tmp.Name(), layerFile); err != nil {
+		return "", v1.Hash{}, err
+	}
+	diffID := v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(diffHash.Sum(nil))}
+	return layerFile, diffID, nil
+}
+
+// writeImage 创建新的镜像目录，基础镜像的layer文件使用硬链接，newLayer移动到镜像目录并解压，
+// newLayer为空时不添加layer。镜像hash和pull的镜像一样取自manifest的digest，返回新镜像的hash
+func writeImage(baseHash string, baseLayers []string, newLayer string, config *v1.ConfigFile, repoTag string) (string, error) {
+	rawConfig, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	configDigest, _, err := v1.SHA256(bytes.NewReader(rawConfig))
+	if err != nil {
+		return "", err
+	}
+	// 先在临时目录中创建，得到hash后再移动到镜像目录
+	tmpPath, err := os.MkdirTemp(common.TempDir, "image-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpPath)
+	basePath := common.ImageBaseDir + baseHash
+	for _, layer := range baseLayers {
+		if err := os.Link(path.Join(basePath, layer), path.Join(tmpPath, layer)); err != nil {
+			return "", fmt.Errorf("unable to link layer %s %w", layer, err)
+		}
+	}
+	layers := append([]string{}, baseLayers...)
+	if newLayer != "" {
+		layerName := path.Base(newLayer)
+		if err := os.Rename(newLayer, path.Join(tmpPath, layerName)); err != nil {
+			return "", err
+		}
+		layers = append(layers, layerName)
+	}
+	configName := configDigest.String()
+	if err := os.WriteFile(path.Join(tmpPath, configName), rawConfig, 0644); err != nil {
+		return "", err
+	}
+	manifest := []Manifest{{Config: configName, Layers: layers}}
+	if repoTag != "" {
+		manifest[0].RepoTags = []string{repoTag}
+	}
+	data, _ := json.Marshal(manifest)
+	if err := os.WriteFile(path.Join(tmpPath, "manifest.json"), data, 0644); err != nil {
+		return "", err
+	}
+	image, err := loadImageFromPath(tmpPath)
+	if err != nil {
+		return "", err
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		return "", err
+	}
+	rawManifest, err := image.RawManifest()
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path.Join(tmpPath, rawManifestFile), rawManifest, 0644); err != nil {
+		return "", err
+	}
+	imageHash := digest.Hex[:12]
+	if same, err := checkImageDigest(imageHash, digest); err != nil {
+		return "", err
+	} else if same {
+		return imageHash, nil
+	}
+	if err := os.Rename(tmpPath, common.ImageBaseDir+imageHash); err != nil {
+		return "", err
+	}
+	if err := saveImageDigest(imageHash, digest); err != nil {
+		return "", err
+	}
+	// 基础镜像的layer已经在共享目录中，只会解压新的layer
+	if err := untarLayers(imageHash); err != nil {
+		return "", err
+	}
+	return imageHash, nil
+}
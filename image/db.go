@@ -1,27 +1,110 @@
 package image
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/StellarisJAY/my-container/common"
 	"github.com/StellarisJAY/my-container/util"
 	"github.com/boltdb/bolt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"os"
 	"path"
+	"strconv"
+	"strings"
 )
 
 type Database struct{}
 
 const (
 	dbFile = common.ImageBaseDir + "image.db"
+	// storeVersionFile 记录镜像目录的版本，版本低于storeVersion时需要迁移
+	storeVersionFile = common.ImageBaseDir + "version"
+	storeVersion     = 1
 )
 
 var errImageFound = errors.New("image found")
 
+// imageRecord 数据库中镜像名和tag对应的镜像，旧版本只记录了镜像hash
+type imageRecord struct {
+	Hash     string `json:"Hash"`
+	Platform string `json:"Platform"`
+}
+
+func decodeRecord(data []byte) imageRecord {
+	var record imageRecord
+	if len(data) > 0 && data[0] == '{' && json.Unmarshal(data, &record) == nil {
+		return record
+	}
+	return imageRecord{Hash: string(data)}
+}
+
 func init() {
 	util.Must(util.CreateDirsIfNotExist([]string{path.Dir(dbFile)}), "Unable to create database dir")
 }
 
-func storeImage(name, tag, hash string) error {
+// Migrate 将旧版本的镜像数据库和layer迁移到当前格式，全部完成后记录版本，之后不再检查。
+// 由使用镜像的命令调用，容器内部的子命令和健康检查不需要迁移
+func Migrate() error {
+	if data, err := os.ReadFile(storeVersionFile); err == nil {
+		if version, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && version >= storeVersion {
+			return nil
+		}
+	}
+	unlock, err := lockLayerStore(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := migrateImageNames(); err != nil {
+		return fmt.Errorf("unable to migrate image database %w", err)
+	}
+	if !migrateLayerStore() {
+		// 还有镜像没有迁移，下次执行时继续
+		return nil
+	}
+	return os.WriteFile(storeVersionFile, []byte(strconv.Itoa(storeVersion)), 0644)
+}
+
+// migrateImageNames 旧版本数据库中的镜像名没有registry，例如redis，改为规范化的docker.io/library/redis
+func migrateImageNames() error {
+	db, err := bolt.Open(dbFile, 0644, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		renames := make(map[string]string)
+		_ = tx.ForEach(func(imageName []byte, _ *bolt.Bucket) error {
+			repo, err := name.NewRepository(string(imageName))
+			if err != nil {
+				return nil
+			}
+			if normalized := repositoryName(repo); normalized != string(imageName) {
+				renames[string(imageName)] = normalized
+			}
+			return nil
+		})
+		for oldName, newName := range renames {
+			src := tx.Bucket([]byte(oldName))
+			dest, err := tx.CreateBucketIfNotExists([]byte(newName))
+			if err != nil {
+				return err
+			}
+			if err := src.ForEach(func(tag, hash []byte) error {
+				return dest.Put(tag, hash)
+			}); err != nil {
+				return err
+			}
+			if err := tx.DeleteBucket([]byte(oldName)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func storeImage(name, tag, hash, platform string) error {
 	db, err := bolt.Open(dbFile, 0644, nil)
 	if err != nil {
 		return err
@@ -32,29 +115,35 @@ func storeImage(name, tag, hash string) error {
 		if err != nil {
 			return err
 		}
-		return b.Put([]byte(tag), []byte(hash))
+		data, _ := json.Marshal(&imageRecord{Hash: hash, Platform: platform})
+		return b.Put([]byte(tag), data)
 	})
 }
 
 func getImageHash(name, tag string) (string, error) {
-	db, err := bolt.Open(dbFile, 0644, nil)
+	record, err := getImageRecord(name, tag)
 	if err != nil {
 		return "", err
 	}
+	return record.Hash, nil
+}
+
+func getImageRecord(name, tag string) (imageRecord, error) {
+	db, err := bolt.Open(dbFile, 0644, nil)
+	if err != nil {
+		return imageRecord{}, err
+	}
 	defer db.Close()
-	var hash string
+	var record imageRecord
 	e := db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(name))
 		if b == nil {
 			return nil
 		}
-		hash = string(b.Get([]byte(tag)))
+		record = decodeRecord(b.Get([]byte(tag)))
 		return nil
 	})
-	if e != nil {
-		return "", e
-	}
-	return hash, nil
+	return record, e
 }
 
 func GetImageNameAndTagByHash(hash string) ([]string, error) {
@@ -67,7 +156,7 @@ func GetImageNameAndTagByHash(hash string) ([]string, error) {
 	e := db.View(func(tx *bolt.Tx) error {
 		return tx.ForEach(func(imageName []byte, b *bolt.Bucket) error {
 			return b.ForEach(func(tag, v []byte) error {
-				if string(v) == hash {
+				if decodeRecord(v).Hash == hash {
 					result[0], result[1] = string(imageName), string(tag)
 					return errImageFound
 				}
@@ -90,10 +179,57 @@ func ListImages() error {
 	defer db.Close()
 	return db.View(func(tx *bolt.Tx) error {
 		return tx.ForEach(func(imageName []byte, b *bolt.Bucket) error {
-			return b.ForEach(func(tag, hash []byte) error {
-				fmt.Printf("%16s\t%8s\t%12s\n", string(imageName), string(tag), string(hash))
+			return b.ForEach(func(tag, v []byte) error {
+				record := decodeRecord(v)
+				if record.Platform == "" {
+					record.Platform = imagePlatform(record.Hash)
+				}
+				fmt.Printf("%16s\t%8s\t%12s\t%s\n", familiarName(string(imageName)), string(tag), record.Hash, record.Platform)
+				return nil
+			})
+		})
+	})
+}
+
+func deleteImageTag(name, tag string) error {
+	db, err := bolt.Open(dbFile, 0644, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+		if err := b.Delete([]byte(tag)); err != nil {
+			return err
+		}
+		// 镜像名下没有tag时删除bucket
+		if k, _ := b.Cursor().First(); k == nil {
+			return tx.DeleteBucket([]byte(name))
+		}
+		return nil
+	})
+}
+
+// getImageTags 列出镜像hash对应的所有镜像引用
+func getImageTags(hash string) ([]string, error) {
+	db, err := bolt.Open(dbFile, 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var tags []string
+	e := db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(imageName []byte, b *bolt.Bucket) error {
+			return b.ForEach(func(tag, v []byte) error {
+				if decodeRecord(v).Hash == hash {
+					tags = append(tags, joinReference(string(imageName), string(tag)))
+				}
 				return nil
 			})
 		})
 	})
+	return tags, e
 }
@@ -2,47 +2,27 @@ package image
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/StellarisJAY/my-container/common"
-	"github.com/StellarisJAY/my-container/config"
 	"github.com/StellarisJAY/my-container/util"
-	"github.com/google/go-containerregistry/pkg/crane"
-	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"log"
 	"os"
 	"path"
 	"strings"
+	"sync"
 )
 
+// maxConcurrentDownloads 同时下载的layer数量
+const maxConcurrentDownloads = 3
+
 type Manifest struct {
 	Config   string   `json:"Config"`
 	RepoTags []string `json:"RepoTags"`
 	Layers   []string `json:"Layers"`
 }
 
-func pullImageFromCustomSource(src string) (v1.Image, error) {
-	ref, err := name.ParseReference(src)
-	if err != nil {
-		return nil, err
-	}
-	image, err := remote.Image(ref, remote.WithJobs(1))
-	if err != nil {
-		return nil, err
-	}
-	return image, nil
-}
-
-func getImageNameAndTag(src string) (string, string) {
-	parts := strings.Split(src, ":")
-	if len(parts) == 1 {
-		return parts[0], "latest"
-	} else {
-		return parts[0], parts[1]
-	}
-}
-
 func checkImageExistByName(name, tag string) (bool, string) {
 	hash, err := getImageHash(name, tag)
 	if err != nil {
@@ -65,25 +45,43 @@ func checkImageExistByHash(hashHex string) (bool, string, string) {
 	return true, nameAndTag[0], nameAndTag[1]
 }
 
-func storeImageMetadata(name, tag, hashHex string) {
-	if err := storeImage(name, tag, hashHex); err != nil {
-		log.Fatalln(err)
+// checkImageDigest 检查镜像目录是否已经保存了digest对应的镜像。镜像目录以digest的前12位命名，
+// 已有的目录记录了不同的完整digest时返回错误，避免把前12位相同的另一个镜像当作同一个镜像
+func checkImageDigest(imageHash string, digest v1.Hash) (bool, error) {
+	stored, err := imageDigest(imageHash)
+	if err != nil {
+		return false, fmt.Errorf("unable to read digest of image %s %w", imageHash, err)
 	}
+	if stored == (v1.Hash{}) {
+		return false, nil
+	}
+	if stored != digest {
+		return false, fmt.Errorf("image %s is already used by %s, unable to store %s", imageHash, stored, digest)
+	}
+	return true, nil
 }
 
-func downloadImageFile(image v1.Image, src, hashHex string) error {
-	saveDir := common.TempDir
-	_ = util.CreateDirsIfNotExist([]string{saveDir})
-	return crane.Save(image, src, path.Join(saveDir, hashHex+".tar"))
-}
-
-func untarImage(imageHash string) {
-	imageTarPath := common.TempDir + imageHash + ".tar"
-	targetPath := common.ImageBaseDir + imageHash
-	if err := util.Untar(imageTarPath, targetPath); err != nil {
-		log.Fatalln(fmt.Errorf("unable to untar image %w", err))
-		return
+// storeImageMetadata 在数据库中记录镜像名和tag对应的镜像。tag原来指向另一个镜像时给出警告，
+// 例如用-platform拉取了另一个平台，旧镜像没有其他tag时会被image prune删除
+func storeImageMetadata(name, tag, hashHex, platform string) error {
+	old, err := getImageRecord(name, tag)
+	if err != nil {
+		return err
+	}
+	if err := storeImage(name, tag, hashHex, platform); err != nil {
+		return err
+	}
+	if old.Hash == "" || old.Hash == hashHex {
+		return nil
+	}
+	if old.Platform == "" {
+		old.Platform = imagePlatform(old.Hash)
 	}
+	log.Printf("WARNING: %s moved from image %s (%s) to %s (%s)", FamiliarReference(name, tag), old.Hash, old.Platform, hashHex, platform)
+	if tags, err := getImageTags(old.Hash); err == nil && len(tags) == 0 {
+		log.Printf("WARNING: image %s has no tag now and will be removed by image prune", old.Hash)
+	}
+	return nil
 }
 
 func untarLayers(imageHash string) error {
@@ -91,17 +89,31 @@ func untarLayers(imageHash string) error {
 	if err != nil {
 		return err
 	}
+	config, err := ParseConfig(imageHash)
+	if err != nil {
+		return err
+	}
+	diffIDs := config.RootFS.DiffIDs
+	if len(diffIDs) != len(manifest[0].Layers) {
+		return fmt.Errorf("image has %d layers but %d diff_ids", len(manifest[0].Layers), len(diffIDs))
+	}
+	unlock, err := lockLayerStore(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	imagePath := common.ImageBaseDir + imageHash
-	layers := manifest[0].Layers
-	for _, layer := range layers {
-		layerPath := path.Join(imagePath, "layers", strings.TrimSuffix(layer, ".tar.gz")[:16])
-		log.Println("Untar layer: ", layer)
-		// {image}/{layer}.tar.gz 解压到 {container}/fs/{i}/
-		if err := util.Untar(path.Join(imagePath, layer), layerPath); err != nil {
+	for i, layer := range manifest[0].Layers {
+		// lazy pull的layer运行时通过FUSE挂载，不需要解压
+		if isLazyLayer(layer) {
+			continue
+		}
+		// {image}/{layer}.tar.gz 解压到共享的 layers/sha256/{diffID}/
+		if err := extractLayer(path.Join(imagePath, layer), diffIDs[i]); err != nil {
 			return err
 		}
 	}
-	return nil
+	return addLayerRefs(imageHash, diffIDs)
 }
 
 func ParseManifest(imageHash string) ([]Manifest, error) {
@@ -117,36 +129,267 @@ func ParseManifest(imageHash string) ([]Manifest, error) {
 	return m, nil
 }
 
-func DownloadImageIfNotExist(src string) string {
-	imageName, tag := getImageNameAndTag(src)
-	if ok, imageHash := checkImageExistByName(imageName, tag); !ok {
-		log.Printf("Pulling image metadata for %s:%s", imageName, tag)
-		fullName := strings.Join([]string{imageName, tag}, ":")
-		src := config.GlobalConfig.Registries[0] + "/library/" + fullName
-		log.Println("Pulling image from ", src)
-		image, err := pullImageFromCustomSource(src)
+// ParseConfig 读取镜像的config文件
+func ParseConfig(imageHash string) (*v1.ConfigFile, error) {
+	manifest, err := ParseManifest(imageHash)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path.Join(common.ImageBaseDir, imageHash, manifest[0].Config))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read image config %w", err)
+	}
+	defer file.Close()
+	config, err := v1.ParseConfigFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse image config %w", err)
+	}
+	return config, nil
+}
+
+// PullOptions pull和run拉取镜像的选项
+type PullOptions struct {
+	// Platform os/arch[/variant]格式的平台，为空时使用当前主机的平台
+	Platform string
+	// Quiet 不显示拉取进度
+	Quiet bool
+	// Lazy eStargz格式的layer只下载TOC，运行时通过FUSE按需下载文件内容
+	Lazy bool
+}
+
+// PullImage 本地没有镜像或者本地镜像的平台和Platform不同时拉取镜像，返回镜像hash
+func PullImage(src string, opts PullOptions) (string, error) {
+	progress := newPullProgress(opts.Quiet)
+	ref, err := parseReference(src)
+	if err != nil {
+		return "", err
+	}
+	p, err := ParsePlatform(opts.Platform)
+	if err != nil {
+		return "", err
+	}
+	imageName, key := repositoryName(ref.Context()), ref.Identifier()
+	record, err := getImageRecord(imageName, key)
+	if err != nil {
+		return "", err
+	}
+	// 本地已有的镜像也按照信任策略检查，需要签名的仓库中没有有效签名的镜像重新拉取并验证签名
+	if err := checkPullPolicy(ref); err != nil {
+		return "", err
+	}
+	if record.Hash != "" && (opts.Platform == "" || matchPlatform(record, p)) {
+		err := verifyImageSignature(imageName, record.Hash)
+		if err == nil {
+			progress.Printf("Image already exists. Skip download.")
+			return record.Hash, nil
+		}
+		progress.Printf("Local image %s is not trusted, pulling again: %v", record.Hash, err)
+	}
+	progress.Printf("Pulling image metadata for %s, platform: %s", joinReference(imageName, key), p)
+	image, source, err := pullImage(ref, p, progress)
+	if err != nil {
+		return "", err
+	}
+	// 需要签名的仓库在下载layer之前验证签名
+	var sig *imageSignature
+	if keys := signingKeys(imageName); len(keys) > 0 {
+		digest, err := image.Digest()
 		if err != nil {
-			log.Fatal(err)
-			return ""
+			return "", err
 		}
-		digest, _ := image.Digest()
-		imageHashHex := digest.Hex[:12]
-		if exist, altName, altTag := checkImageExistByHash(imageHashHex); exist {
-			log.Printf("Required image %s:%s is the same as %s:%s, skip download", imageName, tag, altName, altTag)
-			storeImageMetadata(imageName, tag, imageHashHex)
-			return imageHashHex
+		if sig, err = fetchSignature(source, digest, imageName, keys); err != nil {
+			return "", fmt.Errorf("unable to verify image signature %w", err)
 		}
-		storeImageMetadata(imageName, tag, imageHashHex)
-		log.Println("Downloading image...")
-		if err := downloadImageFile(image, src, imageHashHex); err != nil {
-			log.Fatalln("Unable to download image ", err)
-			return ""
+		progress.Printf("Verified signature of %s", digest)
+	}
+	blobs, err := newRemoteBlobs(source)
+	if err != nil {
+		return "", err
+	}
+	blobs.lazy = opts.Lazy
+	imageHashHex, err := storeV1Image(image, imageName, key, blobs, progress)
+	if err != nil {
+		return "", fmt.Errorf("unable to download image %w", err)
+	}
+	if sig != nil {
+		data, _ := json.Marshal(sig)
+		if err := os.WriteFile(path.Join(common.ImageBaseDir+imageHashHex, signatureFile), data, 0644); err != nil {
+			return "", fmt.Errorf("unable to save image signature %w", err)
+		}
+	}
+	progress.Printf("Pulled %s, hash: %s", FamiliarReference(imageName, key), imageHashHex)
+	return imageHashHex, nil
+}
+
+// DownloadImageIfNotExist 和PullImage相同，拉取失败时退出
+func DownloadImageIfNotExist(src string, opts PullOptions) string {
+	imageHash, err := PullImage(src, opts)
+	util.Must(err, "Unable to pull image")
+	return imageHash
+}
+
+// matchPlatform 本地镜像的平台是否满足要求
+func matchPlatform(record imageRecord, platform *v1.Platform) bool {
+	if record.Platform == "" {
+		record.Platform = imagePlatform(record.Hash)
+	}
+	p, err := v1.ParsePlatform(record.Platform)
+	return err == nil && p.Satisfies(*platform)
+}
+
+// storeV1Image 将镜像保存到镜像目录并解压layers，在数据库中记录镜像名和tag或digest，返回镜像hash。
+// blobs不为nil时从registry下载layer，可以从中断的位置继续。imageName为空时保存为没有tag的镜像，只能按hash引用
+func storeV1Image(image v1.Image, imageName, tag string, blobs *remoteBlobs, progress *pullProgress) (string, error) {
+	digest, err := image.Digest()
+	if err != nil {
+		return "", err
+	}
+	imageHashHex := digest.Hex[:12]
+	config, err := image.ConfigFile()
+	if err != nil {
+		return "", err
+	}
+	platform := configPlatform(config)
+	// 旧版本保存的镜像没有记录完整digest，不能确认是同一个镜像，重新下载
+	same, err := checkImageDigest(imageHashHex, digest)
+	if err != nil {
+		return "", err
+	}
+	if same {
+		nameAndTag, err := GetImageNameAndTagByHash(imageHashHex)
+		if err != nil {
+			return "", err
+		}
+		if nameAndTag != nil && imageName != "" {
+			progress.Printf("Required image %s is the same as %s, skip download", joinReference(imageName, tag), joinReference(nameAndTag[0], nameAndTag[1]))
 		}
-		untarImage(imageHashHex)
-		util.Must(untarLayers(imageHashHex), "Unable to untar image layers")
-		return imageHashHex
 	} else {
-		log.Println("Image already exists. Skip download.")
-		return imageHash
+		repoTag := ""
+		if imageName != "" {
+			repoTag = joinReference(imageName, tag)
+		}
+		if err := writeV1Image(image, config, digest, repoTag, blobs, progress); err != nil {
+			return "", err
+		}
+	}
+	if imageName == "" {
+		return imageHashHex, nil
+	}
+	if err := storeImageMetadata(imageName, tag, imageHashHex, platform); err != nil {
+		return "", err
+	}
+	return imageHashHex, nil
+}
+
+// writeV1Image 并行下载镜像的layer，直接解压到共享目录，压缩的layer和config、manifest.json保存到镜像目录
+func writeV1Image(image v1.Image, config *v1.ConfigFile, digest v1.Hash, repoTag string, blobs *remoteBlobs, progress *pullProgress) error {
+	imageHash := digest.Hex[:12]
+	layers, err := image.Layers()
+	if err != nil {
+		return err
+	}
+	diffIDs := config.RootFS.DiffIDs
+	if len(diffIDs) != len(layers) {
+		return fmt.Errorf("image has %d layers but %d diff_ids", len(layers), len(diffIDs))
+	}
+	rawConfig, err := image.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	configName, err := image.ConfigName()
+	if err != nil {
+		return err
+	}
+	_ = util.CreateDirsIfNotExist([]string{common.TempDir})
+	// 先在临时目录中创建，全部layer下载完成后再移动到镜像目录
+	tmpPath, err := os.MkdirTemp(common.TempDir, "image-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpPath)
+	if err := os.WriteFile(path.Join(tmpPath, configName.String()), rawConfig, 0644); err != nil {
+		return err
+	}
+	rawManifest, err := image.RawManifest()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path.Join(tmpPath, rawManifestFile), rawManifest, 0644); err != nil {
+		return err
+	}
+	unlock, err := lockLayerStore(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	layerFiles, err := fetchLayers(layers, diffIDs, tmpPath, blobs, progress)
+	if err != nil {
+		return fmt.Errorf("unable to download image layers %w", err)
+	}
+	manifest := []Manifest{{Config: configName.String(), Layers: layerFiles}}
+	if repoTag != "" && !strings.Contains(repoTag, "@") {
+		manifest[0].RepoTags = []string{repoTag}
+	}
+	data, _ := json.Marshal(manifest)
+	if err := os.WriteFile(path.Join(tmpPath, "manifest.json"), data, 0644); err != nil {
+		return err
+	}
+	imagePath := common.ImageBaseDir + imageHash
+	// 中断的pull可能留下没有manifest.json的目录
+	_ = os.RemoveAll(imagePath)
+	if err := os.Rename(tmpPath, imagePath); err != nil {
+		return err
+	}
+	if err := saveImageDigest(imageHash, digest); err != nil {
+		return err
+	}
+	return addLayerRefs(imageHash, diffIDs)
+}
+
+// fetchLayers 最多maxConcurrentDownloads个layer同时下载，相同的layer只下载一次，返回每个layer的文件名
+func fetchLayers(layers []v1.Layer, diffIDs []v1.Hash, imagePath string, blobs *remoteBlobs, progress *pullProgress) ([]string, error) {
+	layerFiles := make([]string, len(layers))
+	errs := make([]error, len(layers))
+	first := make(map[v1.Hash]int)
+	sem := make(chan struct{}, maxConcurrentDownloads)
+	wg := sync.WaitGroup{}
+	for i, layer := range layers {
+		if _, ok := first[diffIDs[i]]; ok {
+			continue
+		}
+		first[diffIDs[i]] = i
+		digest, err := layer.Digest()
+		if err != nil {
+			return nil, err
+		}
+		size, err := layer.Size()
+		if err != nil {
+			return nil, err
+		}
+		lp := progress.addLayer(digest, size)
+		wg.Add(1)
+		go func(i int, layer v1.Layer) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if toc := estargzTOCDigest(layer); blobs != nil && blobs.lazy && toc != "" && !layerExists(diffIDs[i]) {
+				layerFiles[i], errs[i] = fetchLazyLayer(layer, diffIDs[i], toc, blobs, lp)
+			} else {
+				layerFiles[i], errs[i] = fetchLayer(layer, imagePath, diffIDs[i], blobs, lp)
+			}
+			if errs[i] != nil {
+				lp.setStatus("Failed")
+			}
+		}(i, layer)
+	}
+	progress.Start()
+	wg.Wait()
+	progress.Stop()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	for i := range layers {
+		layerFiles[i] = layerFiles[first[diffIDs[i]]]
 	}
+	return layerFiles, nil
 }
@@ -0,0 +1,60 @@
+package image
+
+import (
+	"fmt"
+	"github.com/StellarisJAY/my-container/util"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"time"
+)
+
+// Import 将根文件系统的tar包导入为只有一层layer的镜像，返回镜像hash
+func Import(tarFile, ref string) (string, error) {
+	imageName, tag, err := normalizeTag(ref)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Open(tarFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	// 根据magic bytes识别gzip或zstd压缩的tar包
+	reader, _, err := util.DecompressReader(file)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	layerFile, diffID, err := writeLayer(func(w io.Writer) error {
+		_, err := io.Copy(w, reader)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(layerFile)
+
+	now := v1.Time{Time: time.Now().UTC()}
+	config := &v1.ConfigFile{
+		Architecture: runtime.GOARCH,
+		OS:           "linux",
+		Created:      now,
+		RootFS:       v1.RootFS{Type: "layers", DiffIDs: []v1.Hash{diffID}},
+		History: []v1.History{{
+			Created:   now,
+			CreatedBy: "my-container import",
+			Comment:   fmt.Sprintf("imported from %s", path.Base(tarFile)),
+		}},
+	}
+	imageHash, err := writeImage("", nil, layerFile, config, joinReference(imageName, tag))
+	if err != nil {
+		return "", err
+	}
+	if err := storeImageMetadata(imageName, tag, imageHash, configPlatform(config)); err != nil {
+		return "", err
+	}
+	return imageHash, nil
+}
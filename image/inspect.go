@@ -0,0 +1,173 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/StellarisJAY/my-container/common"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"os"
+	"path"
+	"time"
+)
+
+// ImageInspect image inspect输出的镜像信息
+type ImageInspect struct {
+	Id        string        `json:"Id"`
+	RepoTags  []string      `json:"RepoTags"`
+	Created   time.Time     `json:"Created"`
+	Platform  string        `json:"Platform"`
+	Config    InspectConfig `json:"Config"`
+	Manifest  *v1.Manifest  `json:"Manifest"`
+	Layers    []LayerInfo   `json:"Layers"`
+	TotalSize int64         `json:"TotalSize"`
+}
+
+// InspectConfig 镜像config中运行容器使用的部分
+type InspectConfig struct {
+	Env          []string            `json:"Env"`
+	Entrypoint   []string            `json:"Entrypoint"`
+	Cmd          []string            `json:"Cmd"`
+	WorkingDir   string              `json:"WorkingDir"`
+	User         string              `json:"User"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+	Volumes      map[string]struct{} `json:"Volumes"`
+	Labels       map[string]string   `json:"Labels"`
+}
+
+// LayerInfo layer的digest、diffID和压缩后的大小
+type LayerInfo struct {
+	Digest    string `json:"Digest"`
+	DiffID    string `json:"DiffID"`
+	MediaType string `json:"MediaType"`
+	Size      int64  `json:"Size"`
+}
+
+// HistoryEntry 镜像config的history中的一条记录，EmptyLayer的记录没有对应的layer
+type HistoryEntry struct {
+	Created    time.Time
+	CreatedBy  string
+	Comment    string
+	Size       int64
+	EmptyLayer bool
+}
+
+// Inspect 读取镜像的manifest和config，ref可以是name:tag或镜像hash
+func Inspect(ref string) (*ImageInspect, error) {
+	imageHash, _, err := resolveImage(ref)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := readImageManifest(imageHash)
+	if err != nil {
+		return nil, err
+	}
+	config, err := ParseConfig(imageHash)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := getImageTags(imageHash)
+	if err != nil {
+		return nil, err
+	}
+	inspect := &ImageInspect{
+		Id:       imageHash,
+		RepoTags: []string{},
+		Created:  config.Created.Time,
+		Platform: configPlatform(config),
+		Config: InspectConfig{
+			Env:          config.Config.Env,
+			Entrypoint:   config.Config.Entrypoint,
+			Cmd:          config.Config.Cmd,
+			WorkingDir:   config.Config.WorkingDir,
+			User:         config.Config.User,
+			ExposedPorts: config.Config.ExposedPorts,
+			Volumes:      config.Config.Volumes,
+			Labels:       config.Config.Labels,
+		},
+		Manifest: manifest,
+	}
+	for _, tag := range tags {
+		imageName, key, _ := normalizeReference(tag)
+		inspect.RepoTags = append(inspect.RepoTags, FamiliarReference(imageName, key))
+	}
+	for i, desc := range manifest.Layers {
+		layer := LayerInfo{Digest: desc.Digest.String(), MediaType: string(desc.MediaType), Size: desc.Size}
+		if i < len(config.RootFS.DiffIDs) {
+			layer.DiffID = config.RootFS.DiffIDs[i].String()
+		}
+		inspect.Layers = append(inspect.Layers, layer)
+		inspect.TotalSize += desc.Size
+	}
+	return inspect, nil
+}
+
+// readImageManifest 优先读取pull时保存的registry原始manifest，没有时根据镜像目录重建
+func readImageManifest(imageHash string) (*v1.Manifest, error) {
+	rawManifest, err := os.ReadFile(path.Join(common.ImageBaseDir+imageHash, rawManifestFile))
+	if err == nil {
+		manifest, err := v1.ParseManifest(bytes.NewReader(rawManifest))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse manifest of image %s %w", imageHash, err)
+		}
+		return manifest, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	image, err := LoadImage(imageHash)
+	if err != nil {
+		return nil, err
+	}
+	return image.Manifest()
+}
+
+// History 返回镜像config中的history，最新的记录在前，每条非空记录按顺序对应一个layer。
+// 没有history的镜像（例如旧版本import的镜像）为每个layer返回一条空记录
+func History(ref string) ([]HistoryEntry, error) {
+	imageHash, _, err := resolveImage(ref)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := readImageManifest(imageHash)
+	if err != nil {
+		return nil, err
+	}
+	config, err := ParseConfig(imageHash)
+	if err != nil {
+		return nil, err
+	}
+	history := config.History
+	layerCount := 0
+	for _, h := range history {
+		if !h.EmptyLayer {
+			layerCount++
+		}
+	}
+	if layerCount != len(manifest.Layers) {
+		history = make([]v1.History, len(manifest.Layers))
+	}
+	entries := make([]HistoryEntry, 0, len(history))
+	layer := 0
+	for _, h := range history {
+		entry := HistoryEntry{
+			Created:    h.Created.Time,
+			CreatedBy:  h.CreatedBy,
+			Comment:    h.Comment,
+			EmptyLayer: h.EmptyLayer,
+		}
+		if !h.EmptyLayer {
+			entry.Size = manifest.Layers[layer].Size
+			layer++
+		}
+		entries = append(entries, entry)
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// FormatSize 格式化layer大小，和pull的进度使用相同的单位
+func FormatSize(n int64) string {
+	return formatBytes(n)
+}
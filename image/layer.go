@@ -0,0 +1,566 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/StellarisJAY/my-container/common"
+	"github.com/StellarisJAY/my-container/util"
+	"github.com/boltdb/bolt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"golang.org/x/sys/unix"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// 所有镜像共享的layer目录，每个layer按照diffID只解压一次，layers.db中记录引用layer的镜像
+const (
+	layerDBFile = common.LayerStoreDir + "layers.db"
+	layerBucket = "refs"
+	// contentBucket 解压时记录的layer目录内容的digest，运行前用来检查解压后的layer是否被修改
+	contentBucket = "contents"
+	// imageBucket 镜像hash对应的完整manifest digest，镜像目录只用digest的前12位命名
+	imageBucket = "images"
+	// layerLockFile 解压和引用layer时加共享锁，删除layer时加排他锁
+	layerLockFile = common.LayerStoreDir + "lock"
+)
+
+func init() {
+	util.Must(util.CreateDirsIfNotExist([]string{path.Join(common.LayerStoreDir, "sha256")}), "Unable to create layer store dir")
+}
+
+// lockLayerStore 对共享目录加文件锁，返回解锁函数。
+// pull在解压layer到记录引用之间持有共享锁，prune和删除layer持有排他锁，避免删除还没有记录引用的layer
+func lockLayerStore(exclusive bool) (func(), error) {
+	file, err := os.OpenFile(layerLockFile, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open layer store lock %w", err)
+	}
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	if err := unix.Flock(int(file.Fd()), how); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("unable to lock layer store %w", err)
+	}
+	return func() { _ = file.Close() }, nil
+}
+
+// layerPath 返回layer在共享目录中的路径
+func layerPath(diffID v1.Hash) string {
+	return path.Join(common.LayerStoreDir, diffID.Algorithm, diffID.Hex)
+}
+
+// LayerPaths 返回镜像各个layer解压后的目录，从最底层到最上层
+func LayerPaths(imageHash string) ([]string, error) {
+	config, err := ParseConfig(imageHash)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, diffID := range config.RootFS.DiffIDs {
+		paths = append(paths, layerPath(diffID))
+	}
+	return paths, nil
+}
+
+// extractLayer 将layer文件解压到共享目录，已经存在的layer不会重复解压
+func extractLayer(layerFile string, diffID v1.Hash) error {
+	if layerExists(diffID) {
+		log.Println("Layer already exists: ", diffID)
+		return nil
+	}
+	file, err := os.Open(layerFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	log.Println("Untar layer: ", diffID)
+	return extractLayerStream(file, diffID)
+}
+
+func layerExists(diffID v1.Hash) bool {
+	_, err := os.Stat(layerPath(diffID))
+	return err == nil
+}
+
+// diffIDError 解压后内容的sha256和diffID不一致，重新下载也无法解决
+type diffIDError struct {
+	expected v1.Hash
+	actual   string
+}
+
+func (e *diffIDError) Error() string {
+	return fmt.Sprintf("layer diff_id mismatch, expected %s, got sha256:%s", e.expected, e.actual)
+}
+
+// extractLayerStream 从layer流解压到共享目录，根据magic bytes识别gzip、zstd或未压缩的layer，
+// 同时校验解压后内容的sha256和diffID一致
+func extractLayerStream(compressed io.Reader, diffID v1.Hash) error {
+	target := layerPath(diffID)
+	// 先解压到临时目录，完成后再移动，避免中断的解压留下不完整的layer
+	tmp, err := os.MkdirTemp(path.Dir(target), diffID.Hex+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	// layer的根目录是容器的/，MkdirTemp创建的0700目录会使非root用户无法访问容器中的文件
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+	decompressed, _, err := util.DecompressReader(compressed)
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+	hasher := sha256.New()
+	reader := io.TeeReader(decompressed, hasher)
+	if err := util.UntarLayer(reader, tmp); err != nil {
+		return err
+	}
+	// tar结束标记之后可能还有填充，读完才能得到完整的sha256
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); actual != diffID.Hex {
+		return &diffIDError{expected: diffID, actual: actual}
+	}
+	// 内容和diffID一致，记录解压后目录的digest
+	content, err := util.TreeDigest(tmp)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		if layerExists(diffID) {
+			// 其他进程同时解压了同一个layer，由它记录digest
+			return nil
+		}
+		return err
+	}
+	return saveLayerContent(diffID, content)
+}
+
+// saveLayerContent 记录layer解压后目录的digest
+func saveLayerContent(diffID v1.Hash, content string) error {
+	db, err := bolt.Open(layerDBFile, 0644, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(contentBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(diffID.String()), []byte(content))
+	})
+}
+
+// saveImageDigest 记录镜像hash对应的完整manifest digest
+func saveImageDigest(imageHash string, digest v1.Hash) error {
+	db, err := bolt.Open(layerDBFile, 0644, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(imageBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(imageHash), []byte(digest.String()))
+	})
+}
+
+// imageDigest 返回镜像hash对应的完整manifest digest，旧版本保存的镜像没有记录时返回空的Hash
+func imageDigest(imageHash string) (v1.Hash, error) {
+	db, err := bolt.Open(layerDBFile, 0644, nil)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	defer db.Close()
+	var digest string
+	err = db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(imageBucket)); b != nil {
+			digest = string(b.Get([]byte(imageHash)))
+		}
+		return nil
+	})
+	if err != nil || digest == "" {
+		return v1.Hash{}, err
+	}
+	return v1.NewHash(digest)
+}
+
+// deleteImageDigest 删除镜像的digest记录
+func deleteImageDigest(imageHash string) error {
+	db, err := bolt.Open(layerDBFile, 0644, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(imageBucket)); b != nil {
+			return b.Delete([]byte(imageHash))
+		}
+		return nil
+	})
+}
+
+// verifyLayerContent 检查解压后的layer目录和解压时记录的digest一致。
+// 旧版本解压的layer没有记录digest，不能校验
+func verifyLayerContent(diffID v1.Hash) error {
+	db, err := bolt.Open(layerDBFile, 0644, nil)
+	if err != nil {
+		return err
+	}
+	var expected string
+	err = db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(contentBucket)); b != nil {
+			expected = string(b.Get([]byte(diffID.String())))
+		}
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		return err
+	}
+	if expected == "" {
+		log.Printf("Layer %s has no recorded content digest, its extracted files are not verified", diffID)
+		return nil
+	}
+	actual, err := util.TreeDigest(layerPath(diffID))
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("extracted layer %s was modified, content digest %s does not match %s", diffID, actual, expected)
+	}
+	return nil
+}
+
+// fetchLayer 下载layer，同时解压到共享目录，返回layer文件名。
+// 压缩的layer先写入TempDir/blobs/{digest}.partial，下载中断后再次pull时从已下载的位置继续，
+// 完成后移动到镜像目录供save和push使用
+func fetchLayer(layer v1.Layer, imagePath string, diffID v1.Hash, blobs *remoteBlobs, progress *layerProgress) (string, error) {
+	digest, err := layer.Digest()
+	if err != nil {
+		return "", err
+	}
+	mediaType, err := layer.MediaType()
+	if err != nil {
+		return "", err
+	}
+	compression, err := layerCompression(mediaType)
+	if err != nil {
+		return "", err
+	}
+	_ = util.CreateDirsIfNotExist([]string{path.Join(common.TempDir, "blobs")})
+	partial := path.Join(common.TempDir, "blobs", digest.Hex+".partial")
+	// 关闭文件时释放排他锁，锁一直持有到下载完成的文件被移动到镜像目录
+	file, err := openPartialBlob(partial)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	body, offset, err := openLayer(layer, digest, info.Size(), blobs)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	if err := file.Truncate(offset); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return "", err
+	}
+	progress.resume(offset)
+	// 已下载的部分从文件读取，之后的部分边下载边写入文件
+	downloaded := io.NewSectionReader(file, 0, offset)
+	remain := io.TeeReader(body, io.MultiWriter(file, progress))
+	hasher := sha256.New()
+	reader := io.TeeReader(io.MultiReader(downloaded, remain), hasher)
+	exists := layerExists(diffID)
+	if exists {
+		_, err = io.Copy(io.Discard, reader)
+	} else {
+		err = extractLayerStream(reader, diffID)
+	}
+	if err != nil {
+		var diffErr *diffIDError
+		if errors.As(err, &diffErr) {
+			_ = os.Remove(partial)
+		}
+		return "", err
+	}
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return "", err
+	}
+	progress.setStatus("Verifying")
+	if actual := hex.EncodeToString(hasher.Sum(nil)); actual != digest.Hex {
+		_ = os.Remove(partial)
+		return "", fmt.Errorf("layer digest mismatch, expected %s, got sha256:%s", digest, actual)
+	}
+	fileName := digest.Hex + compression.Extension()
+	if err := os.Rename(partial, path.Join(imagePath, fileName)); err != nil {
+		return "", err
+	}
+	if exists {
+		progress.setStatus("Already exists")
+	} else {
+		progress.setStatus("Pull complete")
+	}
+	return fileName, nil
+}
+
+// openPartialBlob 打开下载中的layer文件并加排他锁。同时pull包含相同layer的镜像时只有持有锁的进程读写这个文件，
+// 等待锁期间文件可能已经被上一个持有者移动或删除，这时重新打开新的文件
+func openPartialBlob(partial string) (*os.File, error) {
+	for {
+		file, err := os.OpenFile(partial, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := unix.Flock(int(file.Fd()), unix.LOCK_EX); err != nil {
+			_ = file.Close()
+			return nil, fmt.Errorf("unable to lock %s %w", partial, err)
+		}
+		locked, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		current, err := os.Stat(partial)
+		if err == nil && os.SameFile(locked, current) {
+			return file, nil
+		}
+		_ = file.Close()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+}
+
+// layerCompression 根据layer的media type判断压缩格式，决定layer文件的后缀
+func layerCompression(mediaType types.MediaType) (util.Compression, error) {
+	switch mediaType {
+	case types.DockerLayer, types.DockerForeignLayer, types.OCILayer, types.OCIRestrictedLayer:
+		return util.Gzip, nil
+	case types.OCILayerZStd:
+		return util.Zstd, nil
+	case types.DockerUncompressedLayer, types.OCIUncompressedLayer, types.OCIUncompressedRestrictedLayer:
+		return util.Uncompressed, nil
+	default:
+		return "", fmt.Errorf("unsupported layer media type %s", mediaType)
+	}
+}
+
+// openLayer 打开压缩的layer，从registry下载时从offset继续，否则从头读取
+func openLayer(layer v1.Layer, digest v1.Hash, offset int64, blobs *remoteBlobs) (io.ReadCloser, int64, error) {
+	if blobs != nil {
+		return blobs.open(digest, offset)
+	}
+	rc, err := layer.Compressed()
+	return rc, 0, err
+}
+
+// addLayerRefs 记录镜像引用了这些layer
+func addLayerRefs(imageHash string, diffIDs []v1.Hash) error {
+	return updateLayerRefs(diffIDs, func(refs []string) []string {
+		for _, ref := range refs {
+			if ref == imageHash {
+				return refs
+			}
+		}
+		return append(refs, imageHash)
+	})
+}
+
+// releaseLayerRefs 删除镜像对layer的引用，没有镜像引用的layer从共享目录中删除
+func releaseLayerRefs(imageHash string, diffIDs []v1.Hash) error {
+	unlock, err := lockLayerStore(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = updateLayerRefs(diffIDs, func(refs []string) []string {
+		var remain []string
+		for _, ref := range refs {
+			if ref != imageHash {
+				remain = append(remain, ref)
+			}
+		}
+		return remain
+	})
+	if err != nil {
+		return err
+	}
+	refs, err := layerRefs()
+	if err != nil {
+		return err
+	}
+	for _, diffID := range diffIDs {
+		if len(refs[diffID.String()]) > 0 {
+			continue
+		}
+		removeLazyLayers(diffID)
+		if !layerExists(diffID) {
+			continue
+		}
+		log.Println("Deleted layer: ", diffID)
+		if err := os.RemoveAll(layerPath(diffID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func updateLayerRefs(diffIDs []v1.Hash, update func(refs []string) []string) error {
+	db, err := bolt.Open(layerDBFile, 0644, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(layerBucket))
+		if err != nil {
+			return err
+		}
+		for _, diffID := range diffIDs {
+			var refs []string
+			if data := b.Get([]byte(diffID.String())); data != nil {
+				if err := json.Unmarshal(data, &refs); err != nil {
+					return err
+				}
+			}
+			refs = update(refs)
+			if len(refs) == 0 {
+				if err := b.Delete([]byte(diffID.String())); err != nil {
+					return err
+				}
+				continue
+			}
+			data, _ := json.Marshal(refs)
+			if err := b.Put([]byte(diffID.String()), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// layerRefs 返回每个layer被哪些镜像引用
+func layerRefs() (map[string][]string, error) {
+	db, err := bolt.Open(layerDBFile, 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	result := make(map[string][]string)
+	e := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(layerBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(diffID, data []byte) error {
+			var refs []string
+			if err := json.Unmarshal(data, &refs); err != nil {
+				return err
+			}
+			result[string(diffID)] = refs
+			return nil
+		})
+	})
+	return result, e
+}
+
+// pruneLayerStore 删除共享目录中没有被任何镜像引用的layer和中断的解压留下的临时目录
+func pruneLayerStore() error {
+	unlock, err := lockLayerStore(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	refs, err := layerRefs()
+	if err != nil {
+		return err
+	}
+	dir := path.Join(common.LayerStoreDir, "sha256")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if len(refs["sha256:"+entry.Name()]) > 0 {
+			continue
+		}
+		log.Println("Remove orphaned layer dir: ", entry.Name())
+		if err := os.RemoveAll(path.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateLayerStore 将旧版本保存在{image}/layers/{layer前16位}的layer迁移到共享目录，返回是否全部迁移完成。
+// 被运行中的容器挂载的镜像暂不迁移，下次执行时再迁移
+func migrateLayerStore() bool {
+	entries, err := os.ReadDir(common.ImageBaseDir)
+	if err != nil {
+		return false
+	}
+	mounts, _ := os.ReadFile("/proc/mounts")
+	done := true
+	for _, entry := range entries {
+		oldLayers := path.Join(common.ImageBaseDir, entry.Name(), "layers")
+		if _, err := os.Stat(oldLayers); err != nil {
+			continue
+		}
+		if strings.Contains(string(mounts), oldLayers+"/") {
+			done = false
+			continue
+		}
+		if err := migrateImageLayers(entry.Name(), oldLayers); err != nil {
+			log.Println("Unable to migrate layers of image ", entry.Name(), ": ", err)
+			done = false
+		}
+	}
+	return done
+}
+
+// migrateImageLayers 从镜像目录中的layer文件重新解压每个layer到共享目录，然后删除旧的layers目录。
+// 旧版本解压的目录没有转换whiteout、没有保留所有者和权限，也没有校验diffID，不能直接移动到共享目录
+func migrateImageLayers(imageHash, oldLayers string) error {
+	manifest, err := ParseManifest(imageHash)
+	if err != nil {
+		return err
+	}
+	config, err := ParseConfig(imageHash)
+	if err != nil {
+		return err
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest[0].Layers) {
+		return fmt.Errorf("image has %d layers but %d diff_ids", len(manifest[0].Layers), len(config.RootFS.DiffIDs))
+	}
+	for i, layer := range manifest[0].Layers {
+		if err := extractLayer(path.Join(common.ImageBaseDir, imageHash, layer), config.RootFS.DiffIDs[i]); err != nil {
+			return fmt.Errorf("unable to extract layer %s %w", layer, err)
+		}
+	}
+	if err := addLayerRefs(imageHash, config.RootFS.DiffIDs); err != nil {
+		return err
+	}
+	log.Println("Migrated layers of image ", imageHash)
+	return os.RemoveAll(oldLayers)
+}
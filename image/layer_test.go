@@ -0,0 +1,156 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/StellarisJAY/my-container/common"
+	"github.com/StellarisJAY/my-container/util"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOpenPartialBlobWaitsForRename(t *testing.T) {
+	dir := t.TempDir()
+	partial := filepath.Join(dir, "blob.partial")
+	first, err := openPartialBlob(partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.WriteString("complete blob"); err != nil {
+		t.Fatal(err)
+	}
+	opened := make(chan *os.File)
+	go func() {
+		second, err := openPartialBlob(partial)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- second
+	}()
+	select {
+	case <-opened:
+		t.Fatal("partial blob opened while another writer holds it")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// 第一个下载完成后移动文件再释放锁，等待的下载不能继续写入已经移走的文件
+	if err := os.Rename(partial, filepath.Join(dir, "blob")); err != nil {
+		t.Fatal(err)
+	}
+	_ = first.Close()
+	second := <-opened
+	if second == nil {
+		return
+	}
+	defer second.Close()
+	info, err := second.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Fatalf("second writer resumed from the renamed blob, size %d", info.Size())
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "complete blob" {
+		t.Fatalf("renamed blob was changed to %q", data)
+	}
+}
+
+// writeOldImage 在镜像目录中按旧版本的格式创建只有一个layer的镜像，layers目录中是旧版本Untar解压的结果
+func writeOldImage(t *testing.T, imageHash string, headers []*tar.Header) v1.Hash {
+	layer := &bytes.Buffer{}
+	tw := tar.NewWriter(layer)
+	for _, h := range headers {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	diffID, _, err := v1.SHA256(bytes.NewReader(layer.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := &bytes.Buffer{}
+	gw := gzip.NewWriter(compressed)
+	_, _ = gw.Write(layer.Bytes())
+	_ = gw.Close()
+	digest, _, _ := v1.SHA256(bytes.NewReader(compressed.Bytes()))
+
+	imagePath := path.Join(common.ImageBaseDir, imageHash)
+	t.Cleanup(func() {
+		_ = releaseLayerRefs(imageHash, []v1.Hash{diffID})
+		_ = os.RemoveAll(imagePath)
+	})
+	layerName := digest.Hex + ".tar.gz"
+	oldLayer := path.Join(imagePath, "layers", digest.Hex[:16])
+	if err := os.MkdirAll(oldLayer, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range headers {
+		if err := os.WriteFile(path.Join(oldLayer, h.Name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config, _ := json.Marshal(&v1.ConfigFile{OS: "linux", RootFS: v1.RootFS{Type: "layers", DiffIDs: []v1.Hash{diffID}}})
+	manifest, _ := json.Marshal([]Manifest{{Config: "config.json", Layers: []string{layerName}}})
+	files := map[string][]byte{layerName: compressed.Bytes(), "config.json": config, "manifest.json": manifest}
+	for name, data := range files {
+		if err := os.WriteFile(path.Join(imagePath, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return diffID
+}
+
+func TestMigrateImageLayersReextracts(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must run as root to restore ownership and create whiteouts")
+	}
+	imageHash := "0ddba11c0ffe"
+	diffID := writeOldImage(t, imageHash, []*tar.Header{
+		{Name: util.WhiteoutPrefix + "gone", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "secret", Typeflag: tar.TypeReg, Mode: 0600, Uid: 1000, Gid: 1000},
+	})
+	if err := migrateImageLayers(imageHash, path.Join(common.ImageBaseDir, imageHash, "layers")); err != nil {
+		t.Fatal(err)
+	}
+	target := layerPath(diffID)
+	gone, err := os.Lstat(path.Join(target, "gone"))
+	if err != nil || !util.IsOverlayWhiteout(gone) {
+		t.Errorf("whiteout not converted to an overlay whiteout: %v", err)
+	}
+	if _, err := os.Lstat(path.Join(target, util.WhiteoutPrefix+"gone")); !os.IsNotExist(err) {
+		t.Errorf("old whiteout file moved into the layer store: %v", err)
+	}
+	secret, err := os.Lstat(path.Join(target, "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat := secret.Sys().(*syscall.Stat_t); secret.Mode().Perm() != 0600 || stat.Uid != 1000 || stat.Gid != 1000 {
+		t.Errorf("secret: mode %v owner %d:%d, expected 0600 1000:1000", secret.Mode(), stat.Uid, stat.Gid)
+	}
+	if _, err := os.Stat(path.Join(common.ImageBaseDir, imageHash, "layers")); !os.IsNotExist(err) {
+		t.Errorf("old layers dir not removed: %v", err)
+	}
+	// 重新解压时记录了内容digest，之后的修改可以被发现
+	if err := verifyLayerContent(diffID); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(target, "secret"), []byte("modified"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyLayerContent(diffID); err == nil {
+		t.Error("modified layer passed verification, content digest was not recorded")
+	}
+}
@@ -0,0 +1,426 @@
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/StellarisJAY/my-container/common"
+	"github.com/StellarisJAY/my-container/util"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	godigest "github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// lazy pull的eStargz layer不解压到共享目录，lazy目录中按blob digest保存：
+// {digest}.json 元数据，{digest}.blob 已下载部分的稀疏缓存，{digest}.chunks 每个块是否已下载。
+// 运行容器时每个进程把layer通过FUSE挂载到mnt/{pid}/{digest}，进程退出前卸载。
+// FUSE由挂载layer的进程提供服务，只在这个进程运行期间可用：run一直运行到容器退出，
+// build、cp和diff在返回前卸载。挂载的进程退出后overlay中的lazy layer无法读取，由之后的MountLayers清理
+var (
+	lazyDir      = path.Join(common.LayerStoreDir, "lazy")
+	lazyMountDir = path.Join(lazyDir, "mnt")
+)
+
+// lazyChunkSize blob缓存的块大小，也是按需下载的最小单位
+const lazyChunkSize = 1 << 20
+
+type lazyLayer struct {
+	// Repository layer所在的仓库，例如localhost:5000/app
+	Repository string  `json:"Repository"`
+	Digest     v1.Hash `json:"Digest"`
+	DiffID     v1.Hash `json:"DiffID"`
+	Size       int64   `json:"Size"`
+	TOCDigest  string  `json:"TOCDigest"`
+}
+
+// lazyMount 当前进程挂载的eStargz layer
+type lazyMount struct {
+	server *fuse.Server
+	cache  *blobCache
+}
+
+var (
+	lazyMountsLock sync.Mutex
+	lazyMounts     = make(map[string]*lazyMount)
+)
+
+// estargzTOCDigest 返回eStargz layer在manifest中记录的TOC digest，不是eStargz时返回空字符串
+func estargzTOCDigest(layer v1.Layer) string {
+	desc, err := partial.Descriptor(layer)
+	if err != nil {
+		return ""
+	}
+	return desc.Annotations[estargz.TOCJSONDigestAnnotation]
+}
+
+// fetchLazyLayer 只下载eStargz layer的footer和TOC并校验TOC digest，文件内容在容器读取时按需下载
+func fetchLazyLayer(layer v1.Layer, diffID v1.Hash, tocDigest string, blobs *remoteBlobs, progress *layerProgress) (string, error) {
+	digest, err := layer.Digest()
+	if err != nil {
+		return "", err
+	}
+	fileName := digest.Hex + util.Gzip.Extension()
+	if _, err := readLazyLayer(digest); err == nil {
+		progress.setStatus("Already exists")
+		return fileName, nil
+	}
+	size, err := layer.Size()
+	if err != nil {
+		return "", err
+	}
+	_ = util.CreateDirsIfNotExist([]string{lazyDir})
+	l := &lazyLayer{Repository: blobs.repo.Name(), Digest: digest, DiffID: diffID, Size: size, TOCDigest: tocDigest}
+	progress.setStatus("Fetching TOC")
+	cache, err := openBlobCache(l, blobs)
+	if err != nil {
+		return "", err
+	}
+	defer cache.Close()
+	if _, _, err := openStargz(cache, l); err != nil {
+		return "", err
+	}
+	data, _ := json.Marshal(l)
+	if err := os.WriteFile(lazyLayerFile(digest, ".json"), data, 0644); err != nil {
+		return "", err
+	}
+	progress.setStatus("Pull complete (lazy)")
+	return fileName, nil
+}
+
+func lazyLayerFile(digest v1.Hash, suffix string) string {
+	return path.Join(lazyDir, digest.Hex+suffix)
+}
+
+// isLazyLayer 镜像目录中的layer文件是否是lazy pull的，lazy pull的layer没有layer文件
+func isLazyLayer(layer string) bool {
+	hex, _ := splitLayerFile(layer)
+	_, err := readLazyLayer(v1.Hash{Algorithm: "sha256", Hex: hex})
+	return err == nil
+}
+
+// CheckFullyPulled 检查镜像的layer文件都在镜像目录中。lazy pull的layer只有元数据，
+// 在它上面commit或build的镜像缺少layer文件，save、push和校验都要依赖registry仍然可以访问
+func CheckFullyPulled(imageHash string) error {
+	manifest, err := ParseManifest(imageHash)
+	if err != nil {
+		return err
+	}
+	for _, layer := range manifest[0].Layers {
+		if isLazyLayer(layer) {
+			return fmt.Errorf("layer %s of image %s was pulled lazily, remove the image and pull it again without -lazy to commit or build on it", layer, imageHash)
+		}
+	}
+	return nil
+}
+
+// readLazyLayer 读取lazy pull的layer的元数据，不是lazy pull的layer返回os.ErrNotExist
+func readLazyLayer(digest v1.Hash) (*lazyLayer, error) {
+	data, err := os.ReadFile(lazyLayerFile(digest, ".json"))
+	if err != nil {
+		return nil, err
+	}
+	l := &lazyLayer{}
+	if err := json.Unmarshal(data, l); err != nil {
+		return nil, fmt.Errorf("invalid lazy layer metadata %s %w", digest, err)
+	}
+	return l, nil
+}
+
+// openStargz 从blob缓存打开eStargz layer，校验TOC的digest和manifest中记录的一致
+func openStargz(cache *blobCache, l *lazyLayer) (*estargz.Reader, estargz.TOCEntryVerifier, error) {
+	r, err := estargz.Open(io.NewSectionReader(cache, 0, l.Size))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open eStargz layer %s %w", l.Digest, err)
+	}
+	verifier, err := r.VerifyTOC(godigest.Digest(l.TOCDigest))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to verify eStargz layer %s %w", l.Digest, err)
+	}
+	return r, verifier, nil
+}
+
+// openLazyBlob 读取完整的lazy layer，用于save和push，未下载的部分从registry下载
+func openLazyBlob(digest v1.Hash) (io.ReadCloser, int64, error) {
+	l, err := readLazyLayer(digest)
+	if err != nil {
+		return nil, 0, err
+	}
+	cache, err := openBlobCache(l, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(cache, 0, l.Size), cache}, l.Size, nil
+}
+
+// MountLayers 返回镜像各个layer的目录，从最底层到最上层。
+// lazy pull的layer通过FUSE在当前进程中挂载，使用layer的overlay卸载之前当前进程不能退出，
+// 之后调用UnmountLazyLayers卸载当前进程挂载的layer
+func MountLayers(imageHash string) ([]string, error) {
+	manifest, err := ParseManifest(imageHash)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := LayerPaths(imageHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) != len(manifest[0].Layers) {
+		return nil, fmt.Errorf("image has %d layers but %d diff_ids", len(manifest[0].Layers), len(paths))
+	}
+	cleanupLazyMounts()
+	for i, layer := range manifest[0].Layers {
+		if _, err := os.Stat(paths[i]); err == nil {
+			continue
+		}
+		hex, _ := splitLayerFile(layer)
+		l, err := readLazyLayer(v1.Hash{Algorithm: "sha256", Hex: hex})
+		if err != nil {
+			return nil, fmt.Errorf("layer %s is not extracted %w", layer, err)
+		}
+		if paths[i], err = mountLazyLayer(l); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// mountLazyLayer 在当前进程中通过FUSE挂载eStargz layer，返回挂载点
+func mountLazyLayer(l *lazyLayer) (string, error) {
+	lazyMountsLock.Lock()
+	defer lazyMountsLock.Unlock()
+	mnt := path.Join(lazyMountDir, strconv.Itoa(os.Getpid()), l.Digest.Hex)
+	if _, ok := lazyMounts[mnt]; ok {
+		return mnt, nil
+	}
+	cache, err := openBlobCache(l, nil)
+	if err != nil {
+		return "", err
+	}
+	r, verifier, err := openStargz(cache, l)
+	if err != nil {
+		cache.Close()
+		return "", err
+	}
+	if err := os.MkdirAll(mnt, 0755); err != nil {
+		cache.Close()
+		return "", err
+	}
+	server, err := fs.Mount(mnt, newStargzRoot(r, verifier), &fs.Options{
+		MountOptions: fuse.MountOptions{
+			AllowOther:  true,
+			DirectMount: true,
+			FsName:      "estargz",
+			Name:        "my-container",
+		},
+		NullPermissions: true,
+	})
+	if err != nil {
+		cache.Close()
+		return "", fmt.Errorf("unable to mount eStargz layer %s %w", l.Digest, err)
+	}
+	lazyMounts[mnt] = &lazyMount{server: server, cache: cache}
+	log.Println("Mounted lazy layer: ", l.Digest)
+	return mnt, nil
+}
+
+// UnmountLazyLayers 卸载当前进程挂载的eStargz layer
+func UnmountLazyLayers() {
+	lazyMountsLock.Lock()
+	defer lazyMountsLock.Unlock()
+	for mnt, m := range lazyMounts {
+		if err := m.server.Unmount(); err != nil {
+			_ = unix.Unmount(mnt, unix.MNT_DETACH)
+		}
+		m.cache.Close()
+		_ = os.Remove(mnt)
+		delete(lazyMounts, mnt)
+	}
+	_ = os.Remove(path.Join(lazyMountDir, strconv.Itoa(os.Getpid())))
+}
+
+// cleanupLazyMounts 卸载已经退出的进程留下的FUSE挂载点。
+// 提供服务的进程退出后挂载点返回ENOTCONN，pid被其他进程复用时也根据这一点判断，不会卸载正在使用的挂载点
+func cleanupLazyMounts() {
+	entries, err := os.ReadDir(lazyMountDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		_, err := os.Stat(path.Join("/proc", entry.Name()))
+		exited := err != nil
+		dir := path.Join(lazyMountDir, entry.Name())
+		mounts, _ := os.ReadDir(dir)
+		// 只删除空的挂载点目录，卸载失败时不会删除FUSE中的内容
+		for _, m := range mounts {
+			mnt := path.Join(dir, m.Name())
+			if _, err := os.Stat(mnt); !exited && !errors.Is(err, unix.ENOTCONN) {
+				continue
+			}
+			_ = unix.Unmount(mnt, unix.MNT_DETACH)
+			_ = os.Remove(mnt)
+		}
+		if exited {
+			_ = os.Remove(dir)
+		}
+	}
+}
+
+// removeLazyLayers 删除diffID对应的lazy layer的元数据和缓存
+func removeLazyLayers(diffID v1.Hash) {
+	entries, err := os.ReadDir(lazyDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		hex, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		digest := v1.Hash{Algorithm: "sha256", Hex: hex}
+		if l, err := readLazyLayer(digest); err != nil || l.DiffID != diffID {
+			continue
+		}
+		log.Println("Deleted lazy layer: ", digest)
+		for _, suffix := range []string{".json", ".blob", ".chunks"} {
+			_ = os.Remove(lazyLayerFile(digest, suffix))
+		}
+	}
+}
+
+// blobCache 以lazyChunkSize为单位从registry按需下载blob，已下载的块保存在稀疏文件中
+type blobCache struct {
+	layer   *lazyLayer
+	blobs   *remoteBlobs
+	file    *os.File
+	chunks  *os.File
+	present []bool
+	mu      sync.Mutex
+}
+
+// openBlobCache 打开layer的blob缓存，blobs为nil时第一次下载前根据layer记录的仓库创建
+func openBlobCache(l *lazyLayer, blobs *remoteBlobs) (*blobCache, error) {
+	file, err := os.OpenFile(lazyLayerFile(l.Digest, ".blob"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(l.Size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	chunks, err := os.OpenFile(lazyLayerFile(l.Digest, ".chunks"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	present := make([]byte, (l.Size+lazyChunkSize-1)/lazyChunkSize)
+	if _, err := chunks.ReadAt(present, 0); err != nil && err != io.EOF {
+		file.Close()
+		chunks.Close()
+		return nil, err
+	}
+	c := &blobCache{layer: l, blobs: blobs, file: file, chunks: chunks, present: make([]bool, len(present))}
+	for i, p := range present {
+		c.present[i] = p == 1
+	}
+	return c, nil
+}
+
+func (c *blobCache) ReadAt(p []byte, off int64) (int, error) {
+	if off >= c.layer.Size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > c.layer.Size {
+		end = c.layer.Size
+	}
+	if err := c.fetch(off/lazyChunkSize, (end-1)/lazyChunkSize); err != nil {
+		return 0, err
+	}
+	n, err := c.file.ReadAt(p[:end-off], off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// fetch 下载first到last之间缺少的块，连续的块使用一个Range请求下载
+func (c *blobCache) fetch(first, last int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for first <= last && c.present[first] {
+		first++
+	}
+	for last >= first && c.present[last] {
+		last--
+	}
+	if first > last {
+		return nil
+	}
+	if c.blobs == nil {
+		blobs, err := c.remote()
+		if err != nil {
+			return err
+		}
+		c.blobs = blobs
+	}
+	start := first * lazyChunkSize
+	end := (last + 1) * lazyChunkSize
+	if end > c.layer.Size {
+		end = c.layer.Size
+	}
+	body, err := c.blobs.openRange(c.layer.Digest, start, end-start)
+	if err != nil {
+		return fmt.Errorf("unable to fetch layer %s %w", c.layer.Digest, err)
+	}
+	defer body.Close()
+	n, err := io.Copy(io.NewOffsetWriter(c.file, start), body)
+	if err != nil {
+		return err
+	}
+	if n != end-start {
+		return fmt.Errorf("unable to fetch layer %s: %w", c.layer.Digest, io.ErrUnexpectedEOF)
+	}
+	marks := make([]byte, last-first+1)
+	for i := range marks {
+		marks[i] = 1
+		c.present[first+int64(i)] = true
+	}
+	_, err = c.chunks.WriteAt(marks, first)
+	return err
+}
+
+// remote 根据layer记录的仓库创建下载blob的客户端
+func (c *blobCache) remote() (*remoteBlobs, error) {
+	repo, err := name.NewRepository(c.layer.Repository)
+	if err != nil {
+		return nil, err
+	}
+	var opts []name.Option
+	if registryConfig(repo.RegistryStr()).Insecure {
+		opts = append(opts, name.Insecure)
+	}
+	ref, err := name.NewDigest(c.layer.Repository+"@"+c.layer.Digest.String(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return newRemoteBlobs(ref)
+}
+
+func (c *blobCache) Close() error {
+	return errors.Join(c.file.Close(), c.chunks.Close())
+}
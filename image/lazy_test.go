@@ -0,0 +1,435 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/StellarisJAY/my-container/common"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	godigest "github.com/opencontainers/go-digest"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stargzCompression 和estargz的gzip压缩相同，只是手动构造footer：
+// 新版本的compress/gzip写出的空footer不是estargz要求的51字节，estargz.Build会panic
+type stargzCompression struct {
+	*estargz.GzipCompressor
+	*estargz.GzipDecompressor
+}
+
+func (c stargzCompression) WriteTOCAndFooter(w io.Writer, off int64, toc *estargz.JTOC, diffHash hash.Hash) (godigest.Digest, error) {
+	tocJSON, err := json.MarshalIndent(toc, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	gz := gzip.NewWriter(w)
+	gw := io.Writer(gz)
+	if diffHash != nil {
+		gw = io.MultiWriter(gz, diffHash)
+	}
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: estargz.TOCTarName, Size: int64(len(tocJSON))}); err != nil {
+		return "", err
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return "", err
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	// gzip头和记录TOC位置的extra字段，之后是空的stored block和全为0的crc32、长度
+	footer := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 26, 0, 'S', 'G', 22, 0}
+	footer = append(footer, fmt.Sprintf("%016xSTARGZ", off)...)
+	footer = append(footer, 1, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0)
+	if _, err := w.Write(footer); err != nil {
+		return "", err
+	}
+	return godigest.FromBytes(tocJSON), nil
+}
+
+// buildStargz 将files按顺序打包为eStargz layer，不压缩使内容长度相同的文件在blob中的位置相同
+func buildStargz(t *testing.T, files []tarEntry) (*estargz.Blob, []byte) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, f := range files {
+		header := &tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.body)), ModTime: time.Unix(0, 0)}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := estargz.Build(io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())), estargz.WithChunkSize(64<<10),
+		estargz.WithCompression(stargzCompression{estargz.NewGzipCompressorWithLevel(gzip.NoCompression), &estargz.GzipDecompressor{}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blob.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return blob, data
+}
+
+type tarEntry struct {
+	name string
+	body string
+}
+
+// lazyRegistry 启动httptest registry，推送一个eStargz layer和一个普通gzip layer的镜像，
+// 返回镜像引用和blob的GET请求计数
+func lazyRegistry(t *testing.T, files []tarEntry) (name.Reference, *atomic.Int32) {
+	blob, data := buildStargz(t, files)
+	stargzLayer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainLayer, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := mutate.Append(empty.Image,
+		mutate.Addendum{Layer: stargzLayer, Annotations: map[string]string{estargz.TOCJSONDigestAnnotation: blob.TOCDigest().String()}},
+		mutate.Addendum{Layer: plainLayer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobGets := &atomic.Int32{}
+	handler := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") {
+			blobGets.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	ref, err := name.ParseReference(strings.TrimPrefix(server.URL, "http://") + "/test/lazy:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, image); err != nil {
+		t.Fatal(err)
+	}
+	return ref, blobGets
+}
+
+// useLazyDir 把lazy layer的元数据、缓存和挂载点放在临时目录中
+func useLazyDir(t *testing.T) {
+	oldDir, oldMountDir := lazyDir, lazyMountDir
+	lazyDir = t.TempDir()
+	lazyMountDir = path.Join(lazyDir, "mnt")
+	t.Cleanup(func() {
+		lazyDir, lazyMountDir = oldDir, oldMountDir
+	})
+}
+
+// lazyPull 从registry读取镜像并lazy pull第一个layer，返回layer的元数据
+func lazyPull(t *testing.T, ref name.Reference) (*lazyLayer, []v1.Layer) {
+	image, err := remote.Image(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := image.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	toc := estargzTOCDigest(layers[0])
+	if toc == "" {
+		t.Fatal("TOC digest annotation not found on the eStargz layer")
+	}
+	blobs, err := newRemoteBlobs(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs.lazy = true
+	digest, _ := layers[0].Digest()
+	diffID, _ := layers[0].DiffID()
+	progress := newPullProgress(true).addLayer(digest, 0)
+	if _, err := fetchLazyLayer(layers[0], diffID, toc, blobs, progress); err != nil {
+		t.Fatal(err)
+	}
+	l, err := readLazyLayer(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, layers
+}
+
+// readLazyFile 不经过FUSE，直接用文件节点读取lazy layer中的文件
+func readLazyFile(r *estargz.Reader, verifier estargz.TOCEntryVerifier, name string) ([]byte, error) {
+	entry, ok := r.Lookup(name)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	node := &stargzNode{r: r, verifier: verifier, entry: entry}
+	buf := make([]byte, entry.Size)
+	result, errno := node.Read(context.Background(), nil, buf, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	data, _ := result.Bytes(buf)
+	return data, nil
+}
+
+// gzipMemberEnd 返回blob中从offset开始的gzip member的结束位置
+func gzipMemberEnd(t *testing.T, blob []byte, offset int64) int64 {
+	r := bytes.NewReader(blob[offset:])
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz.Multistream(false)
+	if _, err := io.Copy(io.Discard, gz); err != nil {
+		t.Fatal(err)
+	}
+	return int64(len(blob)) - int64(r.Len())
+}
+
+func countPresent(cache *blobCache) int {
+	n := 0
+	for _, p := range cache.present {
+		if p {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLazyPullFetchesChunksOnDemand(t *testing.T) {
+	useLazyDir(t)
+	big := make([]byte, 3*lazyChunkSize)
+	if _, err := rand.Read(big); err != nil {
+		t.Fatal(err)
+	}
+	ref, blobGets := lazyRegistry(t, []tarEntry{
+		{name: "small.txt", body: "hello lazy pull\n"},
+		{name: "big.bin", body: string(big)},
+	})
+	l, _ := lazyPull(t, ref)
+	cache, err := openBlobCache(l, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	// pull只下载了footer和TOC所在的块
+	if present := countPresent(cache); present == 0 || present >= len(cache.present) {
+		t.Fatalf("expected only the TOC to be fetched, %d of %d chunks present", present, len(cache.present))
+	}
+	if cache.present[0] {
+		t.Fatal("file contents were fetched during pull")
+	}
+	r, verifier, err := openStargz(cache, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gets := blobGets.Load()
+	data, err := readLazyFile(r, verifier, "small.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello lazy pull\n" {
+		t.Errorf("unexpected content %q", data)
+	}
+	if blobGets.Load() != gets+1 {
+		t.Errorf("expected one blob request for small.txt, got %d", blobGets.Load()-gets)
+	}
+	if !cache.present[0] || countPresent(cache) == len(cache.present) {
+		t.Errorf("expected only the chunk of small.txt to be fetched, %d of %d chunks present", countPresent(cache), len(cache.present))
+	}
+	// 已下载的块从缓存读取
+	gets = blobGets.Load()
+	if _, err := readLazyFile(r, verifier, "small.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if blobGets.Load() != gets {
+		t.Error("cached chunk was fetched again")
+	}
+	data, err = readLazyFile(r, verifier, "big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, big) {
+		t.Error("big.bin content mismatch")
+	}
+}
+
+func TestMountLazyLayer(t *testing.T) {
+	useLazyDir(t)
+	ref, _ := lazyRegistry(t, []tarEntry{{name: "small.txt", body: "hello lazy pull\n"}})
+	l, _ := lazyPull(t, ref)
+	mnt, err := mountLazyLayer(l)
+	if err != nil {
+		t.Skip("unable to mount FUSE: ", err)
+	}
+	defer UnmountLazyLayers()
+	data, err := os.ReadFile(path.Join(mnt, "small.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello lazy pull\n" {
+		t.Errorf("unexpected content %q", data)
+	}
+	// 当前进程的挂载点可以正常访问，清理时不能卸载
+	cleanupLazyMounts()
+	if _, err := os.Stat(path.Join(mnt, "small.txt")); err != nil {
+		t.Errorf("mount of a running process was cleaned up: %v", err)
+	}
+	UnmountLazyLayers()
+	if _, err := os.Stat(mnt); !os.IsNotExist(err) {
+		t.Errorf("mount point not removed: %v", err)
+	}
+}
+
+func TestLazyChunkVerifiedAgainstTOC(t *testing.T) {
+	useLazyDir(t)
+	files := []tarEntry{{name: "small.txt", body: "hello lazy pull\n"}}
+	ref, _ := lazyRegistry(t, files)
+	l, _ := lazyPull(t, ref)
+	// 只有一个字符不同的另一个layer，文件在blob中的位置相同，替换后gzip本身可以正常解压
+	_, tampered := buildStargz(t, []tarEntry{{name: "small.txt", body: "jello lazy pull\n"}})
+	cache, err := openBlobCache(l, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	r, verifier, err := openStargz(cache, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readLazyFile(r, verifier, "small.txt"); err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := r.Lookup("small.txt")
+	ce, _ := r.ChunkEntryForOffset("small.txt", 0)
+	// 用另一个layer中对应的gzip member替换缓存中small.txt的内容，两个member的长度相同
+	cached, err := os.ReadFile(lazyLayerFile(l.Digest, ".blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := gzipMemberEnd(t, tampered, entry.Offset)
+	if gzipMemberEnd(t, cached, entry.Offset) != end {
+		t.Fatal("tampered layer has a different layout")
+	}
+	blobFile, err := os.OpenFile(lazyLayerFile(l.Digest, ".blob"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = blobFile.WriteAt(tampered[entry.Offset:end], entry.Offset)
+	blobFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &stargzNode{r: r, verifier: verifier, entry: entry}
+	if _, err := node.readChunk(ce); !errors.Is(err, errChunkDigest) {
+		t.Errorf("expected chunk digest mismatch, got %v", err)
+	}
+}
+
+func TestLazyPullRejectsWrongTOCDigest(t *testing.T) {
+	useLazyDir(t)
+	ref, _ := lazyRegistry(t, []tarEntry{{name: "small.txt", body: "hello lazy pull\n"}})
+	image, err := remote.Image(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := image.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := newRemoteBlobs(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := layers[0].Digest()
+	diffID, _ := layers[0].DiffID()
+	progress := newPullProgress(true).addLayer(digest, 0)
+	if _, err := fetchLazyLayer(layers[0], diffID, diffID.String(), blobs, progress); err == nil {
+		t.Fatal("expected an error for a TOC digest that does not match")
+	}
+	if _, err := readLazyLayer(digest); !os.IsNotExist(err) {
+		t.Errorf("lazy layer metadata was saved: %v", err)
+	}
+}
+
+func TestLazyPullFallsBackForPlainLayer(t *testing.T) {
+	useLazyDir(t)
+	ref, _ := lazyRegistry(t, []tarEntry{{name: "small.txt", body: "hello lazy pull\n"}})
+	image, err := remote.Image(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := image.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 没有TOC annotation的layer由fetchLayers完整下载和解压
+	if toc := estargzTOCDigest(layers[1]); toc != "" {
+		t.Errorf("plain gzip layer reported TOC digest %s", toc)
+	}
+	digest, _ := layers[1].Digest()
+	if isLazyLayer(digest.Hex + ".tar.gz") {
+		t.Error("plain gzip layer is treated as a lazy layer")
+	}
+}
+
+func TestCommitRefusesLazyBase(t *testing.T) {
+	useLazyDir(t)
+	ref, _ := lazyRegistry(t, []tarEntry{{name: "small.txt", body: "hello lazy pull\n"}})
+	l, _ := lazyPull(t, ref)
+	// 镜像目录中只有manifest和config，lazy pull的layer没有layer文件
+	baseHash := l.Digest.Hex[:12]
+	basePath := path.Join(common.ImageBaseDir, baseHash)
+	if err := os.MkdirAll(basePath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(basePath)
+	})
+	config, _ := json.Marshal(&v1.ConfigFile{OS: "linux", RootFS: v1.RootFS{Type: "layers", DiffIDs: []v1.Hash{l.DiffID}}})
+	manifest, _ := json.Marshal([]Manifest{{Config: "config.json", Layers: []string{l.Digest.Hex + ".tar.gz"}}})
+	for name, data := range map[string][]byte{"config.json": config, "manifest.json": manifest} {
+		if err := os.WriteFile(path.Join(basePath, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := CreateImage(baseHash, "", &v1.ConfigFile{}, v1.History{CreatedBy: "test"})
+	if err == nil || !strings.Contains(err.Error(), "pulled lazily") {
+		t.Fatalf("expected an error for the lazy base image, got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"runtime"
+	"strings"
+)
+
+var ErrPlatformNotFound = errors.New("no matching manifest for platform")
+
+// ParsePlatform 解析os/arch[/variant]格式的平台，为空时使用当前主机的平台
+func ParsePlatform(platform string) (*v1.Platform, error) {
+	if platform == "" {
+		return &v1.Platform{OS: "linux", Architecture: runtime.GOARCH}, nil
+	}
+	p, err := v1.ParsePlatform(platform)
+	if err != nil {
+		return nil, fmt.Errorf("invalid platform %q %w", platform, err)
+	}
+	if p.OS == "" || p.Architecture == "" {
+		return nil, fmt.Errorf("invalid platform %q, must be os/arch[/variant]", platform)
+	}
+	return p, nil
+}
+
+// configPlatform 返回镜像config中记录的平台
+func configPlatform(config *v1.ConfigFile) string {
+	if p := config.Platform(); p != nil {
+		return p.String()
+	}
+	return ""
+}
+
+// imagePlatform 读取本地镜像的平台
+func imagePlatform(imageHash string) string {
+	config, err := ParseConfig(imageHash)
+	if err != nil {
+		return ""
+	}
+	return configPlatform(config)
+}
+
+// selectPlatform 镜像索引中选择匹配平台的镜像，单个镜像的平台不匹配时返回错误
+func selectPlatform(desc *remote.Descriptor, platform *v1.Platform) (v1.Image, error) {
+	if !desc.MediaType.IsIndex() {
+		image, err := desc.Image()
+		if err != nil {
+			return nil, err
+		}
+		config, err := image.ConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		if p := config.Platform(); p != nil && !p.Satisfies(*platform) {
+			return nil, fmt.Errorf("%w %s: image is %s", ErrPlatformNotFound, platform, p)
+		}
+		return image, nil
+	}
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	return selectIndexPlatform(index, platform)
+}
+
+// selectIndexPlatform 选择镜像索引中第一个满足平台要求的镜像
+func selectIndexPlatform(index v1.ImageIndex, platform *v1.Platform) (v1.Image, error) {
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	var available []string
+	for _, m := range indexManifest.Manifests {
+		if m.Platform == nil {
+			continue
+		}
+		if m.Platform.Satisfies(*platform) {
+			return index.Image(m.Digest)
+		}
+		available = append(available, m.Platform.String())
+	}
+	return nil, fmt.Errorf("%w %s, available platforms: %s", ErrPlatformNotFound, platform, strings.Join(available, ", "))
+}
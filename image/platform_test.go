@@ -0,0 +1,181 @@
+package image
+
+import (
+	"errors"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"io"
+	"log"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParsePlatform(t *testing.T) {
+	tests := []struct {
+		platform string
+		expected v1.Platform
+	}{
+		{"", v1.Platform{OS: "linux", Architecture: runtime.GOARCH}},
+		{"linux/amd64", v1.Platform{OS: "linux", Architecture: "amd64"}},
+		{"linux/arm/v7", v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{"linux/arm64/v8", v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+	}
+	for _, test := range tests {
+		p, err := ParsePlatform(test.platform)
+		if err != nil {
+			t.Errorf("ParsePlatform(%q): %v", test.platform, err)
+			continue
+		}
+		if p.OS != test.expected.OS || p.Architecture != test.expected.Architecture || p.Variant != test.expected.Variant {
+			t.Errorf("ParsePlatform(%q) = %s, expected %s", test.platform, p, &test.expected)
+		}
+	}
+	for _, platform := range []string{"linux", "linux/", "/amd64"} {
+		if _, err := ParsePlatform(platform); err == nil {
+			t.Errorf("ParsePlatform(%q) accepted an invalid platform", platform)
+		}
+	}
+}
+
+// platformImage 创建config中记录了平台的随机镜像
+func platformImage(t *testing.T, platform string) v1.Image {
+	p, err := v1.ParsePlatform(platform)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := image.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.OS, config.Architecture, config.Variant = p.OS, p.Architecture, p.Variant
+	image, err = mutate.ConfigFile(image, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+// platformIndex 创建包含linux/amd64、linux/arm/v7和linux/arm64/v8的镜像索引，返回索引和每个平台的镜像
+func platformIndex(t *testing.T) (v1.ImageIndex, map[string]v1.Image) {
+	images := make(map[string]v1.Image)
+	var index v1.ImageIndex = empty.Index
+	for _, platform := range []string{"linux/amd64", "linux/arm/v7", "linux/arm64/v8"} {
+		image := platformImage(t, platform)
+		p, _ := v1.ParsePlatform(platform)
+		images[platform] = image
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{
+			Add:        image,
+			Descriptor: v1.Descriptor{Platform: p},
+		})
+	}
+	return index, images
+}
+
+// platformSelectionTests 期望选中的平台为空时没有满足要求的镜像
+var platformSelectionTests = []struct {
+	platform string
+	expected string
+}{
+	{"linux/amd64", "linux/amd64"},
+	{"linux/arm/v7", "linux/arm/v7"},
+	// 没有指定variant时匹配任意variant
+	{"linux/arm", "linux/arm/v7"},
+	{"linux/arm64", "linux/arm64/v8"},
+	{"linux/arm64/v8", "linux/arm64/v8"},
+	// variant不同的同一架构不匹配
+	{"linux/arm/v6", ""},
+	{"linux/arm64/v9", ""},
+	{"windows/amd64", ""},
+}
+
+func assertSelected(t *testing.T, platform string, expected v1.Image, actual v1.Image, err error) {
+	t.Helper()
+	if expected == nil {
+		if !errors.Is(err, ErrPlatformNotFound) {
+			t.Errorf("%s: expected ErrPlatformNotFound, got %v", platform, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("%s: %v", platform, err)
+		return
+	}
+	expectedDigest, _ := expected.Digest()
+	actualDigest, _ := actual.Digest()
+	if expectedDigest != actualDigest {
+		t.Errorf("%s: selected %s, expected %s", platform, actualDigest, expectedDigest)
+	}
+}
+
+func TestSelectIndexPlatform(t *testing.T) {
+	index, images := platformIndex(t)
+	for _, test := range platformSelectionTests {
+		p, err := ParsePlatform(test.platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		image, err := selectIndexPlatform(index, p)
+		assertSelected(t, test.platform, images[test.expected], image, err)
+	}
+	// 没有匹配时错误中列出索引中所有的平台
+	p, _ := ParsePlatform("linux/arm/v6")
+	_, err := selectIndexPlatform(index, p)
+	if err == nil || !strings.Contains(err.Error(), "available platforms: linux/amd64, linux/arm/v7, linux/arm64/v8") {
+		t.Errorf("error does not list the available platforms: %v", err)
+	}
+}
+
+func TestSelectPlatform(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+	index, images := platformIndex(t)
+	indexRef, err := name.ParseReference(host + "/test/platform:index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(indexRef, index); err != nil {
+		t.Fatal(err)
+	}
+	imageRef, err := name.ParseReference(host + "/test/platform:arm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(imageRef, images["linux/arm/v7"]); err != nil {
+		t.Fatal(err)
+	}
+	indexDesc, err := remote.Get(indexRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageDesc, err := remote.Get(imageRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range platformSelectionTests {
+		p, err := ParsePlatform(test.platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		image, err := selectPlatform(indexDesc, p)
+		assertSelected(t, test.platform, images[test.expected], image, err)
+		// 单个镜像按照config中的平台检查
+		var expected v1.Image
+		if test.expected == "linux/arm/v7" {
+			expected = images[test.expected]
+		}
+		image, err = selectPlatform(imageDesc, p)
+		assertSelected(t, test.platform+" (single image)", expected, image, err)
+	}
+}
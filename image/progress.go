@@ -0,0 +1,153 @@
+package image
+
+import (
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sys/unix"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const progressInterval = 200 * time.Millisecond
+
+// pullProgress 显示pull时每个layer的进度，终端中每个layer一行并不断刷新，不是终端时只输出状态变化
+type pullProgress struct {
+	out    io.Writer
+	tty    bool
+	quiet  bool
+	mu     sync.Mutex
+	layers []*layerProgress
+	lines  int
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+type layerProgress struct {
+	p      *pullProgress
+	id     string
+	total  int64
+	done   atomic.Int64
+	base   int64
+	start  time.Time
+	status string
+}
+
+func newPullProgress(quiet bool) *pullProgress {
+	_, err := unix.IoctlGetTermios(int(os.Stderr.Fd()), unix.TCGETS)
+	return &pullProgress{out: os.Stderr, tty: err == nil, quiet: quiet}
+}
+
+// Printf 输出日志，quiet时不输出
+func (p *pullProgress) Printf(format string, args ...any) {
+	if !p.quiet {
+		log.Printf(format, args...)
+	}
+}
+
+// addLayer 添加一个layer的进度
+func (p *pullProgress) addLayer(digest v1.Hash, total int64) *layerProgress {
+	l := &layerProgress{p: p, id: digest.Hex[:12], total: total, start: time.Now(), status: "Waiting"}
+	p.mu.Lock()
+	p.layers = append(p.layers, l)
+	p.mu.Unlock()
+	return l
+}
+
+// Start 终端中定时刷新进度
+func (p *pullProgress) Start() {
+	if p.quiet || !p.tty {
+		return
+	}
+	p.stop, p.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.render()
+			case <-p.stop:
+				p.render()
+				return
+			}
+		}
+	}()
+}
+
+// Stop 停止刷新，输出最终的进度
+func (p *pullProgress) Stop() {
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.stop = nil
+}
+
+func (p *pullProgress) render() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.lines > 0 {
+		// 光标移动到上一次输出的第一行
+		fmt.Fprintf(p.out, "\033[%dA", p.lines)
+	}
+	for _, l := range p.layers {
+		fmt.Fprintf(p.out, "\033[2K%s\n", l.line())
+	}
+	p.lines = len(p.layers)
+}
+
+func (l *layerProgress) line() string {
+	if l.status != "Downloading" {
+		return fmt.Sprintf("%s: %s", l.id, l.status)
+	}
+	done := l.done.Load()
+	speed := float64(done-l.base) / time.Since(l.start).Seconds()
+	return fmt.Sprintf("%s: %s %s/%s %s/s", l.id, l.status, formatBytes(done), formatBytes(l.total), formatBytes(int64(speed)))
+}
+
+// setStatus 更新layer状态，不是终端时输出状态变化
+func (l *layerProgress) setStatus(status string) {
+	l.p.mu.Lock()
+	l.status = status
+	l.p.mu.Unlock()
+	if !l.p.quiet && !l.p.tty {
+		log.Printf("%s: %s", l.id, status)
+	}
+}
+
+// resume 从已经下载的位置继续，offset之前的数据不计入下载速度
+func (l *layerProgress) resume(offset int64) {
+	l.p.mu.Lock()
+	l.done.Store(offset)
+	l.base, l.start = offset, time.Now()
+	l.p.mu.Unlock()
+	if offset > 0 {
+		l.setStatus(fmt.Sprintf("Resuming from %s", formatBytes(offset)))
+	}
+	l.setStatus("Downloading")
+}
+
+// Write 统计已下载的字节数
+func (l *layerProgress) Write(b []byte) (int, error) {
+	l.done.Add(int64(len(b)))
+	return len(b), nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,47 @@
+package image
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"log"
+)
+
+// Push 从镜像目录读取镜像并上传到registry，registry中已经存在的layer不会重复上传
+func Push(src string) error {
+	ref, err := parseReference(src)
+	if err != nil {
+		return err
+	}
+	imageName, key := repositoryName(ref.Context()), ref.Identifier()
+	ok, imageHash := checkImageExistByName(imageName, key)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrImageNotFound, src)
+	}
+	image, err := LoadImage(imageHash)
+	if err != nil {
+		return err
+	}
+	var nameOpts []name.Option
+	if registryConfig(ref.Context().RegistryStr()).Insecure {
+		nameOpts = append(nameOpts, name.Insecure)
+	}
+	dest, err := name.ParseReference(ref.String(), nameOpts...)
+	if err != nil {
+		return err
+	}
+	opts, err := remoteOptions(dest.Context().RegistryStr())
+	if err != nil {
+		return err
+	}
+	log.Println("Pushing image to ", dest)
+	if err := remote.Write(dest, image, opts...); err != nil {
+		return fmt.Errorf("unable to push image %s %w", src, err)
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		return err
+	}
+	log.Printf("Pushed %s, digest: %s", FamiliarReference(imageName, key), digest)
+	return nil
+}
@@ -0,0 +1,71 @@
+package image
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	"strings"
+)
+
+// dockerHubRegistry 数据库中Docker Hub镜像使用的registry名称，和docker的规范化名称一致
+const dockerHubRegistry = "docker.io"
+
+// parseReference 解析镜像引用，没有tag和digest时使用latest
+func parseReference(src string) (name.Reference, error) {
+	ref, err := name.ParseReference(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image reference %q %w", src, err)
+	}
+	return ref, nil
+}
+
+// normalizeReference 将镜像引用规范化为数据库中的镜像名和key，
+// 例如redis => docker.io/library/redis latest，key为tag或者digest
+func normalizeReference(src string) (string, string, error) {
+	ref, err := parseReference(src)
+	if err != nil {
+		return "", "", err
+	}
+	return repositoryName(ref.Context()), ref.Identifier(), nil
+}
+
+// normalizeTag 和normalizeReference相同，但是只接受tag，用于commit、import等创建新镜像的命令
+func normalizeTag(src string) (string, string, error) {
+	t, err := name.NewTag(src)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid image tag %q %w", src, err)
+	}
+	return repositoryName(t.Context()), t.TagStr(), nil
+}
+
+// repositoryName 返回包含registry的完整镜像名
+func repositoryName(repo name.Repository) string {
+	registry := repo.RegistryStr()
+	if registry == name.DefaultRegistry {
+		registry = dockerHubRegistry
+	}
+	return registry + "/" + repo.RepositoryStr()
+}
+
+// joinReference 将镜像名和tag或digest拼接为镜像引用
+func joinReference(imageName, key string) string {
+	if strings.Contains(key, ":") {
+		return imageName + "@" + key
+	}
+	return imageName + ":" + key
+}
+
+// FamiliarReference 返回显示给用户的镜像引用，Docker Hub的镜像省略registry和library/
+func FamiliarReference(imageName, key string) string {
+	return joinReference(familiarName(imageName), key)
+}
+
+func familiarName(imageName string) string {
+	if !strings.HasPrefix(imageName, dockerHubRegistry+"/") {
+		return imageName
+	}
+	imageName = strings.TrimPrefix(imageName, dockerHubRegistry+"/")
+	if short := strings.TrimPrefix(imageName, "library/"); !strings.Contains(short, "/") {
+		return short
+	}
+	return imageName
+}
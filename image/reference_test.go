@@ -0,0 +1,165 @@
+package image
+
+import (
+	"github.com/google/go-containerregistry/pkg/name"
+	"os"
+	"testing"
+)
+
+const testDigest = "sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestNormalizeReference(t *testing.T) {
+	tests := []struct {
+		src       string
+		imageName string
+		key       string
+	}{
+		{"redis", "docker.io/library/redis", "latest"},
+		{"redis:7", "docker.io/library/redis", "7"},
+		{"library/redis:7", "docker.io/library/redis", "7"},
+		{"bitnami/redis:7", "docker.io/bitnami/redis", "7"},
+		{"docker.io/redis", "docker.io/library/redis", "latest"},
+		{"index.docker.io/library/redis", "docker.io/library/redis", "latest"},
+		{"registry.example.com:5000/team/app:v1", "registry.example.com:5000/team/app", "v1"},
+		{"localhost:5000/app", "localhost:5000/app", "latest"},
+		{"redis@" + testDigest, "docker.io/library/redis", testDigest},
+	}
+	for _, test := range tests {
+		imageName, key, err := normalizeReference(test.src)
+		if err != nil {
+			t.Errorf("normalizeReference(%q): %v", test.src, err)
+			continue
+		}
+		if imageName != test.imageName || key != test.key {
+			t.Errorf("normalizeReference(%q) = %s %s, expected %s %s", test.src, imageName, key, test.imageName, test.key)
+		}
+	}
+	for _, src := range []string{"Redis", "redis:bad tag", "redis@sha256:short"} {
+		if _, _, err := normalizeReference(src); err == nil {
+			t.Errorf("normalizeReference(%q) accepted an invalid reference", src)
+		}
+	}
+}
+
+func TestNormalizeTag(t *testing.T) {
+	tests := []struct {
+		src       string
+		imageName string
+		tag       string
+	}{
+		{"my-app", "docker.io/library/my-app", "latest"},
+		{"my-app:v1", "docker.io/library/my-app", "v1"},
+		{"team/my-app:v1", "docker.io/team/my-app", "v1"},
+		{"registry.example.com/team/my-app:v1", "registry.example.com/team/my-app", "v1"},
+	}
+	for _, test := range tests {
+		imageName, tag, err := normalizeTag(test.src)
+		if err != nil {
+			t.Errorf("normalizeTag(%q): %v", test.src, err)
+			continue
+		}
+		if imageName != test.imageName || tag != test.tag {
+			t.Errorf("normalizeTag(%q) = %s %s, expected %s %s", test.src, imageName, tag, test.imageName, test.tag)
+		}
+	}
+	// commit、import创建的镜像只能有tag
+	if _, _, err := normalizeTag("my-app@" + testDigest); err == nil {
+		t.Error("normalizeTag accepted a digest reference")
+	}
+}
+
+func TestRepositoryName(t *testing.T) {
+	tests := []struct {
+		repo     string
+		expected string
+	}{
+		{"redis", "docker.io/library/redis"},
+		{"bitnami/redis", "docker.io/bitnami/redis"},
+		{"index.docker.io/bitnami/redis", "docker.io/bitnami/redis"},
+		{"quay.io/coreos/etcd", "quay.io/coreos/etcd"},
+		{"localhost:5000/app", "localhost:5000/app"},
+	}
+	for _, test := range tests {
+		repo, err := name.NewRepository(test.repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := repositoryName(repo); actual != test.expected {
+			t.Errorf("repositoryName(%q) = %s, expected %s", test.repo, actual, test.expected)
+		}
+	}
+}
+
+func TestFamiliarReference(t *testing.T) {
+	tests := []struct {
+		imageName string
+		key       string
+		expected  string
+	}{
+		{"docker.io/library/redis", "latest", "redis:latest"},
+		{"docker.io/bitnami/redis", "7", "bitnami/redis:7"},
+		// library/下的多级名称省略library/之后会被解析成另一个镜像
+		{"docker.io/library/team/app", "v1", "library/team/app:v1"},
+		{"quay.io/coreos/etcd", "v3", "quay.io/coreos/etcd:v3"},
+		{"registry.example.com:5000/library/app", "v1", "registry.example.com:5000/library/app:v1"},
+		{"docker.io/library/redis", testDigest, "redis@" + testDigest},
+	}
+	for _, test := range tests {
+		if actual := FamiliarReference(test.imageName, test.key); actual != test.expected {
+			t.Errorf("FamiliarReference(%s, %s) = %s, expected %s", test.imageName, test.key, actual, test.expected)
+		}
+		// 显示的引用重新解析后得到同一个镜像
+		imageName, key, err := normalizeReference(test.expected)
+		if err != nil {
+			t.Errorf("normalizeReference(%q): %v", test.expected, err)
+		} else if imageName != test.imageName || key != test.key {
+			t.Errorf("%s normalized to %s %s, expected %s %s", test.expected, imageName, key, test.imageName, test.key)
+		}
+	}
+}
+
+func TestMigrateImageNames(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must run as root to open the image database")
+	}
+	tests := []struct {
+		oldName string
+		newName string
+	}{
+		{"redis", "docker.io/library/redis"},
+		{"my-container-test/app", "docker.io/my-container-test/app"},
+		{"localhost:5000/my-container-test/app", "localhost:5000/my-container-test/app"},
+	}
+	const tag, hash = "my-container-test", "5ca1ab1ec0de"
+	for _, test := range tests {
+		if err := storeImage(test.oldName, tag, hash, ""); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = deleteImageTag(test.oldName, tag)
+			_ = deleteImageTag(test.newName, tag)
+		})
+	}
+	if err := migrateImageNames(); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		record, err := getImageRecord(test.newName, tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Hash != hash {
+			t.Errorf("%s was not migrated to %s", test.oldName, test.newName)
+		}
+		if test.oldName == test.newName {
+			continue
+		}
+		record, err = getImageRecord(test.oldName, tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Hash != "" {
+			t.Errorf("old name %s is still in the database", test.oldName)
+		}
+	}
+}
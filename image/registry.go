@@ -0,0 +1,197 @@
+package image
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/StellarisJAY/my-container/config"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"io"
+	"net/http"
+	"os"
+)
+
+// registryConfig 返回registry的连接配置，Docker Hub可以使用docker.io或index.docker.io作为key
+func registryConfig(registry string) config.RegistryConfig {
+	if c, ok := config.GlobalConfig.RegistryConfigs[registry]; ok {
+		return c
+	}
+	if registry == name.DefaultRegistry {
+		return config.GlobalConfig.RegistryConfigs[dockerHubRegistry]
+	}
+	return config.RegistryConfig{}
+}
+
+// pullReferences 返回拉取镜像依次尝试的地址，Docker Hub的镜像按顺序使用配置的registry和镜像源
+func pullReferences(ref name.Reference) ([]name.Reference, error) {
+	registries := []string{ref.Context().RegistryStr()}
+	if ref.Context().RegistryStr() == name.DefaultRegistry {
+		registries = config.GlobalConfig.Registries
+	}
+	var refs []name.Reference
+	for _, registry := range registries {
+		var opts []name.Option
+		if registryConfig(registry).Insecure {
+			opts = append(opts, name.Insecure)
+		}
+		r, err := name.ParseReference(joinReference(registry+"/"+ref.Context().RepositoryStr(), ref.Identifier()), opts...)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, r)
+	}
+	return refs, nil
+}
+
+// remoteOptions 根据registry的配置创建访问registry的选项，认证信息从docker的config.json和credential helper中获取
+func remoteOptions(registry string) ([]remote.Option, error) {
+	transport, err := registryTransport(registry)
+	if err != nil {
+		return nil, err
+	}
+	return []remote.Option{remote.WithTransport(transport), remote.WithAuthFromKeychain(authn.DefaultKeychain)}, nil
+}
+
+// registryTransport 根据registry的配置设置CA证书和证书验证
+func registryTransport(registry string) (http.RoundTripper, error) {
+	c := registryConfig(registry)
+	if c.CAFile == "" && !c.SkipVerify {
+		return remote.DefaultTransport, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.SkipVerify}
+	if c.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file of registry %s %w", registry, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA file %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := remote.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// pullImage 按顺序从各个registry获取平台匹配的镜像，失败时尝试下一个，同时返回镜像所在的地址
+func pullImage(ref name.Reference, platform *v1.Platform, progress *pullProgress) (v1.Image, name.Reference, error) {
+	refs, err := pullReferences(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	var errs []error
+	for _, r := range refs {
+		progress.Printf("Pulling image from %s", r)
+		image, err := pullImageFrom(r, platform)
+		if err == nil {
+			return image, r, nil
+		}
+		if errors.Is(err, ErrPlatformNotFound) {
+			return nil, nil, fmt.Errorf("unable to pull image %s %w", ref, err)
+		}
+		progress.Printf("Unable to pull image from %s: %v", r.Context().RegistryStr(), err)
+		errs = append(errs, err)
+	}
+	return nil, nil, fmt.Errorf("unable to pull image %s %w", ref, errors.Join(errs...))
+}
+
+func pullImageFrom(ref name.Reference, platform *v1.Platform) (v1.Image, error) {
+	opts, err := remoteOptions(ref.Context().RegistryStr())
+	if err != nil {
+		return nil, err
+	}
+	desc, err := remote.Get(ref, append(opts, remote.WithJobs(1), remote.WithPlatform(*platform))...)
+	if err != nil {
+		return nil, err
+	}
+	return selectPlatform(desc, platform)
+}
+
+// remoteBlobs 直接通过HTTP请求下载registry中的blob，使用Range请求从中断的位置继续下载
+type remoteBlobs struct {
+	repo   name.Repository
+	client *http.Client
+	// lazy eStargz layer只下载TOC，不下载整个layer
+	lazy bool
+}
+
+func newRemoteBlobs(ref name.Reference) (*remoteBlobs, error) {
+	base, err := registryTransport(ref.Context().RegistryStr())
+	if err != nil {
+		return nil, err
+	}
+	auth, err := authn.DefaultKeychain.Resolve(ref.Context())
+	if err != nil {
+		return nil, err
+	}
+	scopes := []string{ref.Scope(transport.PullScope)}
+	t, err := transport.NewWithContext(context.Background(), ref.Context().Registry, auth, base, scopes)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteBlobs{repo: ref.Context(), client: &http.Client{Transport: t}}, nil
+}
+
+// open 从offset开始下载blob，registry不支持Range请求时从头下载，返回实际开始的位置
+func (b *remoteBlobs) open(digest v1.Hash, offset int64) (io.ReadCloser, int64, error) {
+	url := fmt.Sprintf("%s://%s/v2/%s/blobs/%s", b.repo.Scheme(), b.repo.RegistryStr(), b.repo.RepositoryStr(), digest)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := transport.CheckError(resp, http.StatusOK, http.StatusPartialContent); err != nil {
+		resp.Body.Close()
+		return nil, 0, err
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		return resp.Body, offset, nil
+	}
+	return resp.Body, 0, nil
+}
+
+// openRange 下载blob中从offset开始的length字节，用于按需读取eStargz layer。
+// registry不支持Range请求时从头下载并跳过offset之前的内容
+func (b *remoteBlobs) openRange(digest v1.Hash, offset, length int64) (io.ReadCloser, error) {
+	url := fmt.Sprintf("%s://%s/v2/%s/blobs/%s", b.repo.Scheme(), b.repo.RegistryStr(), b.repo.RepositoryStr(), digest)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := transport.CheckError(resp, http.StatusOK, http.StatusPartialContent); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, length), resp.Body}, nil
+}
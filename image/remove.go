@@ -0,0 +1,162 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"github.com/StellarisJAY/my-container/common"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var ErrImageNotFound = errors.New("no such image")
+
+// imageHashPattern 镜像hash是manifest digest的前12位，也可以使用更长的digest
+var imageHashPattern = regexp.MustCompile(`^[0-9a-f]{12,64}$`)
+
+// resolveImage 解析镜像引用或镜像hash，返回镜像hash，byHash表示参数是镜像hash。
+// 只有12位以上小写十六进制的参数会被当作镜像hash，避免把任意参数拼接到镜像目录的路径中
+func resolveImage(ref string) (imageHash string, byHash bool, err error) {
+	if imageName, tag, err := normalizeReference(ref); err == nil {
+		if ok, hash := checkImageExistByName(imageName, tag); ok {
+			return hash, false, nil
+		}
+	}
+	if !imageHashPattern.MatchString(ref) {
+		return "", false, fmt.Errorf("%w: %s", ErrImageNotFound, ref)
+	}
+	imageHash = ref[:12]
+	if _, err := os.Stat(path.Join(common.ImageBaseDir, imageHash, "manifest.json")); err == nil {
+		// 比12位更长的hash还要和完整digest比较
+		if digest, err := imageDigest(imageHash); err == nil && (digest == v1.Hash{} || strings.HasPrefix(digest.Hex, ref)) {
+			return imageHash, true, nil
+		}
+	}
+	return "", false, fmt.Errorf("%w: %s", ErrImageNotFound, ref)
+}
+
+// Tag 为已有的镜像添加新的name:tag
+func Tag(src, dest string) error {
+	imageHash, _, err := resolveImage(src)
+	if err != nil {
+		return err
+	}
+	imageName, tag, err := normalizeTag(dest)
+	if err != nil {
+		return err
+	}
+	return storeImage(imageName, tag, imageHash, imagePlatform(imageHash))
+}
+
+// RemoveImage 删除镜像的tag，镜像没有其他tag时删除镜像文件。
+// 按hash删除有多个tag的镜像需要force。
+// inUse记录每个镜像被哪些容器使用，被容器使用的镜像只有force时才删除tag，镜像文件保留到不再被使用
+func RemoveImage(ref string, force bool, inUse map[string][]string) error {
+	imageHash, byHash, err := resolveImage(ref)
+	if err != nil {
+		return err
+	}
+	tags, err := getImageTags(imageHash)
+	if err != nil {
+		return err
+	}
+	if byHash && len(tags) > 1 && !force {
+		familiar := make([]string, 0, len(tags))
+		for _, t := range tags {
+			imageName, tag, err := normalizeReference(t)
+			if err != nil {
+				return err
+			}
+			familiar = append(familiar, FamiliarReference(imageName, tag))
+		}
+		return fmt.Errorf("image %s is referenced by multiple tags %s, remove them by name or use -f", imageHash, strings.Join(familiar, ", "))
+	}
+	removeTags := tags
+	if !byHash {
+		imageName, tag, _ := normalizeReference(ref)
+		removeTags = []string{joinReference(imageName, tag)}
+	}
+	if len(removeTags) < len(tags) {
+		// 镜像还有其他tag，只删除这个tag
+		return untag(removeTags)
+	}
+	if containers := inUse[imageHash]; len(containers) > 0 {
+		if !force {
+			return fmt.Errorf("image %s is being used by container %s", imageHash, strings.Join(containers, ", "))
+		}
+		log.Printf("Image %s is being used by container %s, only untag it", imageHash, strings.Join(containers, ", "))
+		return untag(removeTags)
+	}
+	if err := untag(removeTags); err != nil {
+		return err
+	}
+	return deleteImageFiles(imageHash)
+}
+
+func untag(tags []string) error {
+	for _, t := range tags {
+		imageName, tag, err := normalizeReference(t)
+		if err != nil {
+			return err
+		}
+		if err := deleteImageTag(imageName, tag); err != nil {
+			return err
+		}
+		log.Println("Untagged: ", FamiliarReference(imageName, tag))
+	}
+	return nil
+}
+
+func deleteImageFiles(imageHash string) error {
+	if config, err := ParseConfig(imageHash); err == nil {
+		if err := releaseLayerRefs(imageHash, config.RootFS.DiffIDs); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(common.ImageBaseDir + imageHash); err != nil {
+		return fmt.Errorf("unable to remove image dir %w", err)
+	}
+	if err := deleteImageDigest(imageHash); err != nil {
+		return err
+	}
+	log.Println("Deleted: ", imageHash)
+	return nil
+}
+
+// Prune 删除没有tag的镜像和共享目录中不属于任何镜像的layer，all为true时删除所有未被容器使用的镜像
+func Prune(all bool, inUse map[string][]string) error {
+	entries, err := os.ReadDir(common.ImageBaseDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		imageHash := entry.Name()
+		if _, err := ParseManifest(imageHash); err != nil {
+			// 没有manifest的目录是中断的pull留下的
+			log.Println("Remove orphaned image dir: ", imageHash)
+			if err := os.RemoveAll(common.ImageBaseDir + imageHash); err != nil {
+				return err
+			}
+			continue
+		}
+		tags, err := getImageTags(imageHash)
+		if err != nil {
+			return err
+		}
+		if len(inUse[imageHash]) == 0 && (len(tags) == 0 || all) {
+			if err := untag(tags); err != nil {
+				return err
+			}
+			if err := deleteImageFiles(imageHash); err != nil {
+				return err
+			}
+		}
+	}
+	return pruneLayerStore()
+}
@@ -0,0 +1,234 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"github.com/StellarisJAY/my-container/util"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// overlayOpaqueXattr overlay的lowerdir中标记目录为opaque的xattr
+const overlayOpaqueXattr = "trusted.overlay.opaque"
+
+var errChunkDigest = errors.New("chunk digest mismatch")
+
+// stargzNode 只读的eStargz layer中的一个文件，和解压后的layer一样，
+// .wh.文件显示为overlay的whiteout字符设备，包含.wh..wh..opq的目录带有opaque xattr
+type stargzNode struct {
+	fs.Inode
+	r        *estargz.Reader
+	verifier estargz.TOCEntryVerifier
+	entry    *estargz.TOCEntry
+	whiteout bool
+	opaque   bool
+
+	// 最近读取的chunk，顺序读取时避免重复解压
+	mu         sync.Mutex
+	chunk      *estargz.TOCEntry
+	chunkBytes []byte
+}
+
+var (
+	_ fs.NodeOnAdder     = (*stargzNode)(nil)
+	_ fs.NodeGetattrer   = (*stargzNode)(nil)
+	_ fs.NodeGetxattrer  = (*stargzNode)(nil)
+	_ fs.NodeListxattrer = (*stargzNode)(nil)
+	_ fs.NodeReadlinker  = (*stargzNode)(nil)
+	_ fs.NodeOpener      = (*stargzNode)(nil)
+	_ fs.NodeReader      = (*stargzNode)(nil)
+)
+
+func newStargzRoot(r *estargz.Reader, verifier estargz.TOCEntryVerifier) *stargzNode {
+	root, _ := r.Lookup("")
+	return &stargzNode{r: r, verifier: verifier, entry: root}
+}
+
+// OnAdd 挂载时根据TOC创建整个目录树，硬链接共享同一个inode
+func (n *stargzNode) OnAdd(ctx context.Context) {
+	inodes := make(map[*estargz.TOCEntry]*fs.Inode)
+	n.addChildren(ctx, &n.Inode, inodes)
+}
+
+func (n *stargzNode) addChildren(ctx context.Context, parent *fs.Inode, inodes map[*estargz.TOCEntry]*fs.Inode) {
+	n.entry.ForeachChild(func(base string, ent *estargz.TOCEntry) bool {
+		if n.entry.Name == "" && (base == estargz.PrefetchLandmark || base == estargz.NoPrefetchLandmark) {
+			return true
+		}
+		if base == util.WhiteoutOpaqueDir {
+			n.opaque = true
+			return true
+		}
+		if strings.HasPrefix(base, util.WhiteoutPrefix) {
+			child := &stargzNode{r: n.r, verifier: n.verifier, entry: ent, whiteout: true}
+			parent.AddChild(strings.TrimPrefix(base, util.WhiteoutPrefix), n.NewPersistentInode(ctx, child, fs.StableAttr{Mode: syscall.S_IFCHR}), true)
+			return true
+		}
+		inode, ok := inodes[ent]
+		if !ok {
+			child := &stargzNode{r: n.r, verifier: n.verifier, entry: ent}
+			inode = n.NewPersistentInode(ctx, child, fs.StableAttr{Mode: child.mode() & syscall.S_IFMT})
+			inodes[ent] = inode
+			if ent.Type == "dir" {
+				child.addChildren(ctx, inode, inodes)
+			}
+		}
+		// whiteout和被删除的文件同名时以whiteout为准
+		parent.AddChild(base, inode, false)
+		return true
+	})
+}
+
+// mode 返回包含文件类型的mode
+func (n *stargzNode) mode() uint32 {
+	if n.whiteout {
+		return syscall.S_IFCHR
+	}
+	mode := uint32(n.entry.Mode & 07777)
+	switch n.entry.Type {
+	case "dir":
+		return mode | syscall.S_IFDIR
+	case "symlink":
+		return mode | syscall.S_IFLNK
+	case "char":
+		return mode | syscall.S_IFCHR
+	case "block":
+		return mode | syscall.S_IFBLK
+	case "fifo":
+		return mode | syscall.S_IFIFO
+	default:
+		return mode | syscall.S_IFREG
+	}
+}
+
+func (n *stargzNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = n.mode()
+	out.Nlink = 1
+	if n.whiteout {
+		return 0
+	}
+	ent := n.entry
+	if ent.NumLink > 0 {
+		out.Nlink = uint32(ent.NumLink)
+	}
+	out.Owner = fuse.Owner{Uid: uint32(ent.UID), Gid: uint32(ent.GID)}
+	switch ent.Type {
+	case "reg":
+		out.Size = uint64(ent.Size)
+	case "symlink":
+		out.Size = uint64(len(ent.LinkName))
+	case "char", "block":
+		out.Rdev = uint32(unix.Mkdev(uint32(ent.DevMajor), uint32(ent.DevMinor)))
+	}
+	out.Blocks = (out.Size + 511) / 512
+	mtime := ent.ModTime()
+	out.SetTimes(&mtime, &mtime, &mtime)
+	return 0
+}
+
+func (n *stargzNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	value, ok := n.xattrs()[attr]
+	if !ok {
+		return 0, syscall.ENODATA
+	}
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), 0
+}
+
+func (n *stargzNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	var names []byte
+	for attr := range n.xattrs() {
+		names = append(append(names, attr...), 0)
+	}
+	if len(dest) < len(names) {
+		return uint32(len(names)), syscall.ERANGE
+	}
+	return uint32(copy(dest, names)), 0
+}
+
+func (n *stargzNode) xattrs() map[string][]byte {
+	if n.whiteout {
+		return nil
+	}
+	if !n.opaque {
+		return n.entry.Xattrs
+	}
+	xattrs := map[string][]byte{overlayOpaqueXattr: []byte("y")}
+	for k, v := range n.entry.Xattrs {
+		xattrs[k] = v
+	}
+	return xattrs
+}
+
+func (n *stargzNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if n.entry.Type != "symlink" {
+		return nil, syscall.EINVAL
+	}
+	return []byte(n.entry.LinkName), 0
+}
+
+func (n *stargzNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	return nil, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+// Read 读取文件内容，需要的chunk从registry按需下载，校验TOC中记录的chunk digest
+func (n *stargzNode) Read(ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	end := off + int64(len(dest))
+	if end > n.entry.Size {
+		end = n.entry.Size
+	}
+	read := 0
+	for off < end {
+		ce, ok := n.r.ChunkEntryForOffset(n.entry.Name, off)
+		if !ok {
+			break
+		}
+		data, err := n.readChunk(ce)
+		if err != nil {
+			log.Printf("Unable to read %s from eStargz layer: %v", n.entry.Name, err)
+			return nil, syscall.EIO
+		}
+		copied := copy(dest[read:end-off+int64(read)], data[off-ce.ChunkOffset:])
+		read += copied
+		off += int64(copied)
+	}
+	return fuse.ReadResultData(dest[:read]), 0
+}
+
+func (n *stargzNode) readChunk(ce *estargz.TOCEntry) ([]byte, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.chunk == ce {
+		return n.chunkBytes, nil
+	}
+	sr, err := n.r.OpenFile(n.entry.Name)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, ce.ChunkSize)
+	if _, err := sr.ReadAt(data, ce.ChunkOffset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	v, err := n.verifier.Verifier(ce)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = v.Write(data)
+	if !v.Verified() {
+		return nil, errChunkDigest
+	}
+	n.chunk, n.chunkBytes = ce, data
+	return data, nil
+}
@@ -0,0 +1,373 @@
+package image
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/StellarisJAY/my-container/common"
+	"github.com/StellarisJAY/my-container/config"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// rawManifestFile 镜像目录中保存的registry原始manifest，镜像hash取自它的digest
+	rawManifestFile = "raw-manifest.json"
+	// signatureFile 镜像目录中保存的已验证的cosign签名
+	signatureFile = "signature.json"
+
+	// cosignSignatureAnnotation cosign签名镜像的layer中保存签名的annotation
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	cosignSignatureType       = "cosign container image signature"
+	atomicSignatureType       = "atomic container signature"
+)
+
+var ErrUnsigned = errors.New("no valid signature found")
+
+// simpleSigning cosign签名的payload，即containers/image的simple signing格式
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]any `json:"optional,omitempty"`
+}
+
+// imageSignature 已验证的签名，Payload为签名的内容
+type imageSignature struct {
+	Payload   []byte `json:"Payload"`
+	Signature []byte `json:"Signature"`
+}
+
+// checkPullPolicy 信任策略要求按digest拉取时拒绝按tag拉取或使用本地镜像
+func checkPullPolicy(ref name.Reference) error {
+	if _, ok := ref.(name.Digest); !ok && config.GlobalConfig.TrustPolicy.RequireDigest {
+		return fmt.Errorf("trust policy requires pulling %s by digest", ref)
+	}
+	return nil
+}
+
+// signingKeys 返回验证仓库签名的公钥文件，仓库不需要签名时返回nil
+func signingKeys(imageName string) []string {
+	for pattern, keys := range config.GlobalConfig.TrustPolicy.SignedRepositories {
+		prefix, wildcard := strings.CutSuffix(pattern, "/*")
+		repo, err := name.NewRepository(prefix)
+		if err != nil {
+			log.Printf("Invalid repository %q in trust policy: %v", pattern, err)
+			continue
+		}
+		normalized := repositoryName(repo)
+		if imageName == normalized || wildcard && strings.HasPrefix(imageName, normalized+"/") {
+			return keys
+		}
+	}
+	return nil
+}
+
+// fetchSignature 从镜像所在的仓库下载cosign签名，返回第一个用keys验证通过并且和镜像digest一致的签名
+func fetchSignature(source name.Reference, digest v1.Hash, imageName string, keys []string) (*imageSignature, error) {
+	publicKeys, err := loadPublicKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	sigRef := source.Context().Tag(fmt.Sprintf("%s-%s.sig", digest.Algorithm, digest.Hex))
+	opts, err := remoteOptions(sigRef.RegistryStr())
+	if err != nil {
+		return nil, err
+	}
+	sigImage, err := remote.Image(sigRef, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("%w for %s %v", ErrUnsigned, source, err)
+	}
+	manifest, err := sigImage.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, desc := range manifest.Layers {
+		encoded, ok := desc.Annotations[cosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+		sig := &imageSignature{}
+		if sig.Signature, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			errs = append(errs, fmt.Errorf("invalid signature encoding %w", err))
+			continue
+		}
+		if sig.Payload, err = readSignaturePayload(sigImage, desc.Digest); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := sig.verify(publicKeys, digest, imageName); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return sig, nil
+	}
+	return nil, fmt.Errorf("%w for %s %v", ErrUnsigned, source, errors.Join(errs...))
+}
+
+func readSignaturePayload(sigImage v1.Image, digest v1.Hash) ([]byte, error) {
+	layer, err := sigImage.LayerByDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	// payload只有几百字节，限制大小避免恶意的签名镜像
+	payload, err := io.ReadAll(io.LimitReader(rc, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if actual := sha256.Sum256(payload); fmt.Sprintf("%x", actual) != digest.Hex {
+		return nil, fmt.Errorf("signature payload digest mismatch, expected %s", digest)
+	}
+	return payload, nil
+}
+
+// verify 验证签名，并检查payload中的manifest digest和仓库与镜像一致
+func (s *imageSignature) verify(publicKeys []crypto.PublicKey, digest v1.Hash, imageName string) error {
+	verified := false
+	for _, key := range publicKeys {
+		if verifySignature(key, s.Payload, s.Signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return errors.New("signature does not match any trusted public key")
+	}
+	payload := &simpleSigning{}
+	if err := json.Unmarshal(s.Payload, payload); err != nil {
+		return fmt.Errorf("invalid signature payload %w", err)
+	}
+	if t := payload.Critical.Type; t != cosignSignatureType && t != atomicSignatureType {
+		return fmt.Errorf("unsupported signature type %q", t)
+	}
+	if payload.Critical.Image.DockerManifestDigest != digest.String() {
+		return fmt.Errorf("signature is for %s, not %s", payload.Critical.Image.DockerManifestDigest, digest)
+	}
+	ref, err := name.ParseReference(payload.Critical.Identity.DockerReference)
+	if err != nil {
+		return fmt.Errorf("invalid docker-reference in signature %w", err)
+	}
+	if signed := repositoryName(ref.Context()); signed != imageName {
+		return fmt.Errorf("signature is for repository %s, not %s", signed, imageName)
+	}
+	return nil
+}
+
+func verifySignature(key crypto.PublicKey, payload, signature []byte) bool {
+	digest := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, digest[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, signature)
+	default:
+		return false
+	}
+}
+
+// loadPublicKeys 读取PEM格式的公钥文件，和cosign generate-key-pair生成的cosign.pub格式相同
+func loadPublicKeys(files []string) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read public key %w", err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data found in public key %s", file)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key %s %w", file, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// VerifyImage 运行前按照信任策略校验本地镜像，src为运行时指定的镜像引用
+func VerifyImage(src, imageHash string) error {
+	imageName, _, err := normalizeReference(src)
+	if err != nil {
+		return err
+	}
+	if config.GlobalConfig.TrustPolicy.VerifyDigests {
+		rawManifest, err := os.ReadFile(path.Join(common.ImageBaseDir+imageHash, rawManifestFile))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to read manifest of image %s %w", imageHash, err)
+		}
+		if err := verifyImageFiles(imageHash, rawManifest); err != nil {
+			return err
+		}
+	}
+	return verifyImageSignature(imageName, imageHash)
+}
+
+// verifyImageSignature 需要签名的仓库中的镜像必须有pull时验证过的签名，签名的digest和本地manifest一致
+func verifyImageSignature(imageName, imageHash string) error {
+	keys := signingKeys(imageName)
+	if len(keys) == 0 {
+		return nil
+	}
+	imagePath := common.ImageBaseDir + imageHash
+	rawManifest, err := os.ReadFile(path.Join(imagePath, rawManifestFile))
+	if err != nil {
+		return fmt.Errorf("unable to read manifest of image %s %w", imageHash, err)
+	}
+	digest, err := verifyManifestDigest(imageHash, rawManifest)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path.Join(imagePath, signatureFile))
+	if err != nil {
+		return fmt.Errorf("%w for image %s", ErrUnsigned, imageName)
+	}
+	sig := &imageSignature{}
+	if err := json.Unmarshal(data, sig); err != nil {
+		return fmt.Errorf("invalid signature of image %s %w", imageHash, err)
+	}
+	publicKeys, err := loadPublicKeys(keys)
+	if err != nil {
+		return err
+	}
+	if err := sig.verify(publicKeys, digest, imageName); err != nil {
+		return fmt.Errorf("%w for image %s %v", ErrUnsigned, imageName, err)
+	}
+	return nil
+}
+
+// verifyManifestDigest 检查镜像目录中原始manifest的digest和保存镜像时记录的完整digest一致，返回manifest的digest。
+// 旧版本保存的镜像没有记录完整digest，只能比较镜像hash的12位
+func verifyManifestDigest(imageHash string, rawManifest []byte) (v1.Hash, error) {
+	digest, _, err := v1.SHA256(bytes.NewReader(rawManifest))
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	expected, err := imageDigest(imageHash)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("unable to read digest of image %s %w", imageHash, err)
+	}
+	if expected == (v1.Hash{}) {
+		log.Printf("Image %s has no recorded manifest digest, only its short hash is compared", imageHash)
+		if !strings.HasPrefix(digest.Hex, imageHash) {
+			return v1.Hash{}, fmt.Errorf("manifest digest %s does not match image %s", digest, imageHash)
+		}
+		return digest, nil
+	}
+	if digest != expected {
+		return v1.Hash{}, fmt.Errorf("manifest digest %s does not match image %s", digest, expected)
+	}
+	return digest, nil
+}
+
+// verifyImageFiles 校验镜像目录中的文件和manifest记录的digest一致，共享目录中解压后的layer和解压时记录的digest一致。
+// 旧版本pull的镜像没有保存原始manifest，只校验config和layer文件
+func verifyImageFiles(imageHash string, rawManifest []byte) error {
+	manifests, err := ParseManifest(imageHash)
+	if err != nil {
+		return err
+	}
+	local := manifests[0]
+	imagePath := common.ImageBaseDir + imageHash
+	configDigest, err := v1.NewHash(local.Config)
+	if err != nil {
+		return fmt.Errorf("invalid config name %s %w", local.Config, err)
+	}
+	if err := verifyFileDigest(path.Join(imagePath, local.Config), configDigest); err != nil {
+		return err
+	}
+	var layerDigests []v1.Hash
+	for _, layer := range local.Layers {
+		hex, _ := splitLayerFile(layer)
+		layerDigests = append(layerDigests, v1.Hash{Algorithm: "sha256", Hex: hex})
+	}
+	if rawManifest == nil {
+		log.Printf("Image %s has no registry manifest, only config and layers are verified", imageHash)
+	} else {
+		if _, err := verifyManifestDigest(imageHash, rawManifest); err != nil {
+			return err
+		}
+		manifest, err := v1.ParseManifest(bytes.NewReader(rawManifest))
+		if err != nil {
+			return fmt.Errorf("unable to parse manifest of image %s %w", imageHash, err)
+		}
+		if manifest.Config.Digest != configDigest {
+			return fmt.Errorf("config %s does not match manifest %s", configDigest, manifest.Config.Digest)
+		}
+		if len(manifest.Layers) != len(layerDigests) {
+			return fmt.Errorf("image has %d layers but manifest has %d", len(layerDigests), len(manifest.Layers))
+		}
+		for i, desc := range manifest.Layers {
+			if desc.Digest != layerDigests[i] {
+				return fmt.Errorf("layer %s does not match manifest %s", layerDigests[i], desc.Digest)
+			}
+		}
+	}
+	config, err := ParseConfig(imageHash)
+	if err != nil {
+		return err
+	}
+	if len(config.RootFS.DiffIDs) != len(local.Layers) {
+		return fmt.Errorf("image has %d layers but %d diff_ids", len(local.Layers), len(config.RootFS.DiffIDs))
+	}
+	for i, layer := range local.Layers {
+		// lazy pull的layer没有layer文件，读取时按照TOC校验每个chunk
+		if isLazyLayer(layer) {
+			continue
+		}
+		if err := verifyFileDigest(path.Join(imagePath, layer), layerDigests[i]); err != nil {
+			return err
+		}
+		// config的digest已经校验，其中的diff_ids可信
+		if err := verifyLayerContent(config.RootFS.DiffIDs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyFileDigest(file string, expected v1.Hash) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	actual, _, err := v1.SHA256(f)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("digest mismatch for %s, expected %s, got %s", path.Base(file), expected, actual)
+	}
+	return nil
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/StellarisJAY/my-container/builder"
 	"github.com/StellarisJAY/my-container/container"
 	"github.com/StellarisJAY/my-container/image"
 	"github.com/StellarisJAY/my-container/network"
 	"github.com/StellarisJAY/my-container/util"
 	"github.com/StellarisJAY/my-container/volume"
+	"io"
 	"log"
 	"os"
+	"os/exec"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -22,6 +29,17 @@ func main() {
 	var (
 		containerId string
 		imageName   string
+		output      string
+		input       string
+		format      string
+		force       bool
+		all         bool
+		username    string
+		password    string
+		stdinPass   bool
+		platform    string
+		quiet       bool
+		lazy        bool
 	)
 	if os.Getuid() != 0 {
 		log.Fatalln("Must run this program with root privilege")
@@ -32,14 +50,49 @@ func main() {
 	fs.IntVar(&opts.MemLimit, "mem", 1<<20, "Set memory limit")
 	fs.StringVar(&containerId, "container", "", "Container id")
 	fs.StringVar(&imageName, "image", "", "Image full name")
+	fs.StringVar(&platform, "platform", "", "Image platform in the form os/arch[/variant]")
+	fs.BoolVar(&quiet, "quiet", false, "Suppress the pull progress output")
+	fs.BoolVar(&lazy, "lazy", false, "Fetch eStargz layers on demand instead of downloading them")
 	fs.StringVar(&opts.Mount, "mount", "", "Mount points")
 	fs.StringVar(&opts.Volume, "volume", "", "Volume")
+	fs.Var((*stringList)(&opts.Env), "e", "Set environment variables, can be repeated")
+	fs.StringVar(&opts.WorkingDir, "workdir", "", "Working directory inside the container")
+	fs.StringVar(&opts.User, "user", "", "User name or uid[:gid] inside the container")
+	fs.StringVar(&opts.Network, "network", "", "Network mode of the container: bridge (default) or host")
+	fs.StringVar(&output, "o", "", "Write to a file, instead of STDOUT")
+	fs.StringVar(&input, "i", "", "Read from tar archive file")
+	fs.StringVar(&format, "format", image.FormatDocker, "Archive format, docker or oci")
+	fs.BoolVar(&force, "f", false, "Force removal")
+	fs.BoolVar(&all, "a", false, "All images, not only untagged ones")
+	fs.StringVar(&username, "u", "", "Registry username")
+	fs.StringVar(&password, "p", "", "Registry password")
+	fs.BoolVar(&stdinPass, "password-stdin", false, "Take the password from stdin")
+	fs.StringVar(&opts.HealthCmd, "health-cmd", "", "Command to run to check health")
+	fs.DurationVar(&opts.HealthInterval, "health-interval", 0, "Time between running the check")
+	fs.DurationVar(&opts.HealthTimeout, "health-timeout", 0, "Maximum time to allow one check to run")
+	fs.IntVar(&opts.HealthRetries, "health-retries", 0, "Consecutive failures needed to report unhealthy")
+	fs.DurationVar(&opts.HealthStartPeriod, "health-start-period", 0, "Start period during which failures are not counted")
+	// 使用镜像的命令先迁移旧版本的镜像数据，child-mode、cp-helper等内部子命令不需要
+	switch cmd {
+	case "run", "commit", "import", "save", "load", "images", "rmi", "tag", "image", "history", "build", "pull", "push":
+		if err := image.Migrate(); err != nil {
+			log.Println("Unable to migrate image store: ", err)
+		}
+	}
 	switch cmd {
 	case "run":
 		_ = fs.Parse(os.Args[2:])
-		imageHash := image.DownloadImageIfNotExist(imageName)
+		imageHash := image.DownloadImageIfNotExist(imageName, image.PullOptions{Platform: platform, Quiet: quiet, Lazy: lazy})
 		log.Println("Image Hash: ", imageHash)
-		containerId := container.CreateContainer(imageHash)
+		if err := image.VerifyImage(imageName, imageHash); err != nil {
+			log.Fatalln("Image verification failed: ", err)
+			return
+		}
+		containerId, err := container.CreateContainer(imageHash)
+		if err != nil {
+			log.Fatalln("Unable to create container: ", err)
+			return
+		}
 		log.Println("Container ID: ", containerId)
 		container.Run(opts, containerId, os.Args[2:])
 	case "child-mode":
@@ -48,28 +101,267 @@ func main() {
 			log.Fatalln("Must provide container exec command")
 			return
 		}
-		container.ExecCommand(containerId, opts, fs.Args())
+		os.Exit(container.ExecCommand(containerId, opts, fs.Args()))
 	case "exec":
 		_ = fs.Parse(os.Args[2:])
-		util.Must(container.ExecInContainer(containerId, fs.Args()), "Unable to exec in container ")
+		if err := container.ExecInContainer(containerId, fs.Args()); err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				os.Exit(container.ExitStatus(exitErr))
+			}
+			log.Fatalln("Unable to exec in container ", err)
+		}
+	case "wait":
+		if len(os.Args) < 3 {
+			log.Fatalln("Usage: my-container wait CONTAINER...")
+			return
+		}
+		for _, id := range os.Args[2:] {
+			exitCode, err := container.Wait(id)
+			if err != nil {
+				log.Fatalln("Unable to wait container ", id, ": ", err)
+				return
+			}
+			fmt.Println(exitCode)
+		}
+	case "top":
+		if len(os.Args) < 3 {
+			log.Fatalln("Usage: my-container top CONTAINER [ps options]")
+			return
+		}
+		if len(os.Args) > 3 {
+			output, err := container.TopWithPsOptions(os.Args[2], os.Args[3:])
+			if err != nil {
+				log.Fatalln("Unable to list container processes: ", err)
+				return
+			}
+			fmt.Print(output)
+			return
+		}
+		processes, err := container.Top(os.Args[2])
+		if err != nil {
+			log.Fatalln("Unable to list container processes: ", err)
+			return
+		}
+		fmt.Printf("%-12s\t%8s\t%8s\t%10s\t%10s\t%s\n", "User", "Pid", "NsPid", "Time", "RSS(KB)", "Command")
+		for _, p := range processes {
+			fmt.Printf("%-12s\t%8s\t%8s\t%10s\t%10s\t%s\n", p.User, p.Pid, p.NsPid, p.CpuTime, p.RSS, p.Command)
+		}
+	case "cp":
+		if len(os.Args) != 4 {
+			log.Fatalln("Usage: my-container cp HOST_PATH CONTAINER:PATH | CONTAINER:PATH HOST_PATH")
+			return
+		}
+		src, dest := os.Args[2], os.Args[3]
+		if id, containerPath, ok := strings.Cut(dest, ":"); ok {
+			util.Must(container.CopyToContainer(id, src, containerPath), "Unable to copy to container")
+		} else if id, containerPath, ok := strings.Cut(src, ":"); ok {
+			util.Must(container.CopyFromContainer(id, containerPath, dest), "Unable to copy from container")
+		} else {
+			log.Fatalln("Must specify a container path as CONTAINER:PATH")
+		}
+	case "cp-helper":
+		if err := container.CopyHelper(os.Args[2:]); err != nil {
+			log.Fatalln(err)
+		}
+	case "diff":
+		if len(os.Args) != 3 {
+			log.Fatalln("Usage: my-container diff CONTAINER")
+			return
+		}
+		changes, err := container.Diff(os.Args[2])
+		if err != nil {
+			log.Fatalln("Unable to diff container: ", err)
+			return
+		}
+		for _, c := range changes {
+			fmt.Println(c.Kind, c.Path)
+		}
+	case "commit":
+		if len(os.Args) != 4 {
+			log.Fatalln("Usage: my-container commit CONTAINER NAME:TAG")
+			return
+		}
+		imageHash, err := container.Commit(os.Args[2], os.Args[3])
+		if err != nil {
+			log.Fatalln("Unable to commit container: ", err)
+			return
+		}
+		log.Println("Image Hash: ", imageHash)
+	case "export":
+		if len(os.Args) < 3 {
+			log.Fatalln("Usage: my-container export CONTAINER [-o FILE]")
+			return
+		}
+		_ = fs.Parse(os.Args[3:])
+		out := os.Stdout
+		if output != "" {
+			f, err := os.Create(output)
+			if err != nil {
+				log.Fatalln("Unable to create output file: ", err)
+				return
+			}
+			defer f.Close()
+			out = f
+		}
+		util.Must(container.Export(os.Args[2], out), "Unable to export container")
+	case "import":
+		if len(os.Args) != 4 {
+			log.Fatalln("Usage: my-container import FILE NAME:TAG")
+			return
+		}
+		imageHash, err := image.Import(os.Args[2], os.Args[3])
+		if err != nil {
+			log.Fatalln("Unable to import image: ", err)
+			return
+		}
+		log.Println("Image Hash: ", imageHash)
+	case "save":
+		refs := parseInterspersed(&fs, os.Args[2:])
+		if len(refs) == 0 || output == "" {
+			log.Fatalln("Usage: my-container save NAME:TAG... -o FILE [-format docker|oci]")
+			return
+		}
+		f, err := os.Create(output)
+		if err != nil {
+			log.Fatalln("Unable to create output file: ", err)
+			return
+		}
+		defer f.Close()
+		util.Must(image.Save(refs, format, f), "Unable to save images")
+	case "load":
+		_ = fs.Parse(os.Args[2:])
+		if input == "" {
+			log.Fatalln("Usage: my-container load -i FILE [-platform os/arch[/variant]]")
+			return
+		}
+		util.Must(image.Load(input, platform), "Unable to load images")
+	case "rm":
+		if len(os.Args) < 3 {
+			log.Fatalln("Usage: my-container rm CONTAINER...")
+			return
+		}
+		for _, id := range os.Args[2:] {
+			util.Must(container.Remove(id), "Unable to remove container "+id)
+		}
 	case "ps":
 		containers, err := container.GetRunningContainers()
 		if err != nil {
 			log.Fatalln("Unable to list running containers: ", err)
 			return
 		}
-		fmt.Printf("%16s\t%8s\t%32s\n", "Container", "Pid", "Image")
+		fmt.Printf("%16s\t%8s\t%32s\t%16s\n", "Container", "Pid", "Image", "Status")
 		for _, c := range containers {
-			fmt.Printf("%16s\t%8s\t%32s\n", c.ContainerId, c.Pid, c.Image)
+			fmt.Printf("%16s\t%8s\t%32s\t%16s\n", c.ContainerId, c.Pid, c.Image, c.Status)
 		}
 	case "images":
-		fmt.Printf("%16s\t%8s\t%12s\n", "Name", "Tag", "Hash")
+		fmt.Printf("%16s\t%8s\t%12s\t%s\n", "Name", "Tag", "Hash", "Platform")
 		if err := image.ListImages(); err != nil {
 			log.Fatalln(err)
 		}
+	case "rmi":
+		refs := parseInterspersed(&fs, os.Args[2:])
+		if len(refs) == 0 {
+			log.Fatalln("Usage: my-container rmi NAME:TAG|HASH... [-f]")
+			return
+		}
+		inUse, err := container.ImagesInUse()
+		util.Must(err, "Unable to list containers")
+		for _, ref := range refs {
+			util.Must(image.RemoveImage(ref, force, inUse), "Unable to remove image "+ref)
+		}
+	case "tag":
+		if len(os.Args) != 4 {
+			log.Fatalln("Usage: my-container tag SOURCE DEST")
+			return
+		}
+		util.Must(image.Tag(os.Args[2], os.Args[3]), "Unable to tag image")
+	case "image":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: my-container image COMMAND args...")
+			return
+		}
+		switch os.Args[2] {
+		case "prune":
+			_ = fs.Parse(os.Args[3:])
+			inUse, err := container.ImagesInUse()
+			util.Must(err, "Unable to list containers")
+			util.Must(image.Prune(all, inUse), "Unable to prune images")
+		case "inspect":
+			if len(os.Args) != 4 {
+				log.Fatalln("Usage: my-container image inspect NAME:TAG")
+				return
+			}
+			inspect, err := image.Inspect(os.Args[3])
+			util.Must(err, "Unable to inspect image")
+			data, _ := json.MarshalIndent(inspect, "", "  ")
+			fmt.Println(string(data))
+		case "history":
+			printHistory(os.Args[3:])
+		default:
+			fmt.Println("unsupported image command: ", os.Args[2])
+		}
+	case "history":
+		printHistory(os.Args[2:])
+	case "build":
+		// build的-f为Dockerfile路径，和其他命令的-f冲突，使用单独的FlagSet
+		buildOpts := &builder.Options{}
+		buildFlags := flag.FlagSet{}
+		buildFlags.StringVar(&buildOpts.Tag, "t", "", "Name and tag of the built image")
+		buildFlags.StringVar(&buildOpts.Dockerfile, "f", "", "Path of the Dockerfile, default is DIR/Dockerfile")
+		buildFlags.BoolVar(&buildOpts.NoCache, "no-cache", false, "Do not use cache when building the image")
+		buildFlags.Float64Var(&buildOpts.Container.CpuLimit, "cpu", 1, "Set cpu limit of RUN instructions")
+		buildFlags.IntVar(&buildOpts.Container.MemLimit, "mem", 1<<20, "Set memory limit of RUN instructions")
+		args := parseInterspersed(&buildFlags, os.Args[2:])
+		if len(args) != 1 || buildOpts.Tag == "" {
+			log.Fatalln("Usage: my-container build -t NAME:TAG [-f Dockerfile] [-no-cache] DIR")
+			return
+		}
+		buildOpts.ContextDir = args[0]
+		imageHash, err := builder.Build(buildOpts)
+		if err != nil {
+			log.Fatalln("Unable to build image: ", err)
+			return
+		}
+		log.Println("Successfully built ", imageHash)
 	case "pull":
 		_ = fs.Parse(os.Args[2:])
-		_ = image.DownloadImageIfNotExist(imageName)
+		imageHash := image.DownloadImageIfNotExist(imageName, image.PullOptions{Platform: platform, Quiet: quiet, Lazy: lazy})
+		if quiet {
+			fmt.Println(imageHash)
+		}
+	case "push":
+		if len(os.Args) != 3 {
+			log.Fatalln("Usage: my-container push NAME:TAG")
+			return
+		}
+		util.Must(image.Push(os.Args[2]), "Unable to push image")
+	case "login":
+		args := parseInterspersed(&fs, os.Args[2:])
+		registry := ""
+		if len(args) > 0 {
+			registry = args[0]
+		}
+		var err error
+		if username == "" {
+			username, err = util.ReadLine("Username: ")
+			util.Must(err, "Unable to read username")
+		}
+		if stdinPass {
+			data, err := io.ReadAll(os.Stdin)
+			util.Must(err, "Unable to read password from stdin")
+			password = strings.TrimRight(string(data), "\r\n")
+		} else if password == "" {
+			password, err = util.ReadPassword("Password: ")
+			util.Must(err, "Unable to read password")
+		}
+		util.Must(image.Login(registry, username, password), "Unable to login")
+	case "logout":
+		registry := ""
+		if len(os.Args) > 2 {
+			registry = os.Args[2]
+		}
+		util.Must(image.Logout(registry), "Unable to logout")
 	case "setup-veth":
 		_ = fs.Parse(os.Args[2:])
 		util.Must(network.SetupVethInNamespace(containerId), "Unable to setup veth in container namespace")
@@ -77,3 +369,51 @@ func main() {
 		volume.HandleCommand(os.Args[2:])
 	}
 }
+
+// printHistory 输出镜像每一层的创建命令和大小，最新的一层在前
+func printHistory(args []string) {
+	if len(args) != 1 {
+		log.Fatalln("Usage: my-container history NAME:TAG")
+		return
+	}
+	history, err := image.History(args[0])
+	util.Must(err, "Unable to read image history")
+	fmt.Printf("%19s\t%-48s\t%8s\t%s\n", "Created", "Created By", "Size", "Comment")
+	for _, h := range history {
+		created := ""
+		if !h.Created.IsZero() {
+			created = h.Created.Local().Format(time.DateTime)
+		}
+		createdBy := strings.Join(strings.Fields(h.CreatedBy), " ")
+		if len(createdBy) > 48 {
+			createdBy = createdBy[:45] + "..."
+		}
+		fmt.Printf("%19s\t%-48s\t%8s\t%s\n", created, createdBy, image.FormatSize(h.Size), h.Comment)
+	}
+}
+
+// stringList 可以重复指定的flag，例如-e A=1 -e B=2
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parseInterspersed 解析参数中穿插在位置参数之间的flag，返回所有位置参数
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		_ = fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
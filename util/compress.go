@@ -0,0 +1,108 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+)
+
+// Compression tar包的压缩格式
+type Compression string
+
+const (
+	Uncompressed Compression = "none"
+	Gzip         Compression = "gzip"
+	Zstd         Compression = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ParseCompression 解析配置中的压缩格式，空字符串使用gzip
+func ParseCompression(s string) (Compression, error) {
+	switch Compression(s) {
+	case "", Gzip:
+		return Gzip, nil
+	case Zstd, Uncompressed:
+		return Compression(s), nil
+	default:
+		return "", fmt.Errorf("unsupported compression %q, expected gzip, zstd or none", s)
+	}
+}
+
+// Extension 返回该压缩格式的tar文件后缀
+func (c Compression) Extension() string {
+	switch c {
+	case Gzip:
+		return ".tar.gz"
+	case Zstd:
+		return ".tar.zst"
+	default:
+		return ".tar"
+	}
+}
+
+// DetectCompression 根据开头的magic bytes判断压缩格式
+func DetectCompression(header []byte) Compression {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return Gzip
+	case bytes.HasPrefix(header, zstdMagic):
+		return Zstd
+	default:
+		return Uncompressed
+	}
+}
+
+// DecompressReader 根据magic bytes自动解压r，未压缩的内容原样返回
+func DecompressReader(r io.Reader) (io.ReadCloser, Compression, error) {
+	br := bufio.NewReader(r)
+	// 内容不足4字节时Peek返回EOF，不足以判断压缩格式的内容当作未压缩处理
+	header, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	switch c := DetectCompression(header); c {
+	case Gzip:
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, "", err
+		}
+		return gr, c, nil
+	case Zstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, "", err
+		}
+		return zr.IOReadCloser(), c, nil
+	default:
+		return io.NopCloser(br), c, nil
+	}
+}
+
+// CompressWriter 返回以c格式压缩写入w的writer，Close时写入压缩格式的结尾，不会关闭w
+func CompressWriter(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	case Uncompressed:
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", c)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
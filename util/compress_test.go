@@ -0,0 +1,85 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	for _, c := range []Compression{Gzip, Zstd, Uncompressed} {
+		archive := buildTar(t, []tarEntry{
+			{name: "etc/", typeflag: tar.TypeDir},
+			{name: "etc/hostname", typeflag: tar.TypeReg, body: string(c) + "\n"},
+		})
+		compressed := &bytes.Buffer{}
+		w, err := CompressWriter(compressed, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(w, archive); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r, detected, err := DecompressReader(compressed)
+		if err != nil {
+			t.Fatalf("%s: %v", c, err)
+		}
+		if detected != c {
+			t.Errorf("%s archive detected as %s", c, detected)
+		}
+		target := t.TempDir()
+		err = UntarReader(r, target, nil)
+		_ = r.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", c, err)
+		}
+		data, err := os.ReadFile(filepath.Join(target, "etc", "hostname"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(c)+"\n" {
+			t.Errorf("%s: etc/hostname = %q after round trip", c, data)
+		}
+	}
+}
+
+func TestDetectCompressionShortInput(t *testing.T) {
+	tests := []struct {
+		header   []byte
+		expected Compression
+	}{
+		{nil, Uncompressed},
+		{[]byte{0x1f}, Uncompressed},
+		{[]byte{0x1f, 0x8b}, Gzip},
+		{[]byte{0x1f, 0x8b, 0x08}, Gzip},
+		{[]byte{0x28, 0xb5, 0x2f}, Uncompressed},
+		{[]byte{0x28, 0xb5, 0x2f, 0xfd}, Zstd},
+		{[]byte("abc"), Uncompressed},
+	}
+	for _, test := range tests {
+		if c := DetectCompression(test.header); c != test.expected {
+			t.Errorf("DetectCompression(%x) = %s, expected %s", test.header, c, test.expected)
+		}
+	}
+	// 不足以判断压缩格式的内容原样返回
+	for _, input := range [][]byte{nil, []byte("a"), {0x1f}, {0x28, 0xb5, 0x2f}} {
+		r, c, err := DecompressReader(bytes.NewReader(input))
+		if err != nil {
+			t.Errorf("DecompressReader(%x): %v", input, err)
+			continue
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != Uncompressed || !bytes.Equal(data, input) {
+			t.Errorf("DecompressReader(%x) = %s %x, expected the input uncompressed", input, c, data)
+		}
+	}
+}
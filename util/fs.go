@@ -1,12 +1,22 @@
 package util
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
 )
 
+// maxSymlinks 解析路径时最多跟随的符号链接数量
+const maxSymlinks = 255
+
 func CreateDirsIfNotExist(dirs []string) error {
 	for _, dir := range dirs {
 		_, err := os.Stat(dir)
@@ -35,3 +45,137 @@ func CreateFileIfNotExist(path string) error {
 	}
 	return nil
 }
+
+// SecureJoin 将unsafePath拼接到root下，路径中的符号链接和..都在root内解析，结果不会逃逸出root
+func SecureJoin(root, unsafePath string) (string, error) {
+	current := ""
+	remaining := unsafePath
+	links := 0
+	for remaining != "" {
+		var part string
+		if i := strings.IndexByte(remaining, '/'); i == -1 {
+			part, remaining = remaining, ""
+		} else {
+			part, remaining = remaining[:i], remaining[i+1:]
+		}
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			// 在root处停止，不会回到root之外
+			if current = filepath.Dir(current); current == "." {
+				current = ""
+			}
+			continue
+		}
+		next := filepath.Join(current, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if errors.Is(err, os.ErrNotExist) {
+			current = next
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("too many symlinks in %s", unsafePath)
+		}
+		dest, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		// 绝对路径的链接以root为根
+		if filepath.IsAbs(dest) {
+			current = ""
+		}
+		remaining = dest + "/" + remaining
+	}
+	return filepath.Join(root, current), nil
+}
+
+// TreeDigest 按路径顺序计算目录中每个文件的类型、权限、所有者、修改时间、扩展属性和内容的sha256，
+// 用来检查解压后的目录是否被修改。根目录本身不计算在内，访问时间不计算在内
+func TreeDigest(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("unable to stat %s", file)
+		}
+		fmt.Fprintf(h, "%q %o %d:%d %d %d", rel, stat.Mode, stat.Uid, stat.Gid, stat.Rdev, info.ModTime().UnixNano())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, " -> %q", link)
+		case info.Mode().IsRegular():
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			content := sha256.New()
+			_, err = io.Copy(content, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, " %d %x", info.Size(), content.Sum(nil))
+		}
+		xattrs, err := listXattrs(file)
+		if err != nil {
+			return err
+		}
+		for _, attr := range xattrs {
+			fmt.Fprintf(h, " %q", attr)
+		}
+		_, err = h.Write([]byte{'\n'})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// listXattrs 返回文件所有扩展属性的name=value，按名称排序，文件系统不支持扩展属性时返回nil
+func listXattrs(file string) ([]string, error) {
+	size, err := unix.Llistxattr(file, nil)
+	if errors.Is(err, unix.ENOTSUP) || size == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(file, buf); err != nil {
+		return nil, err
+	}
+	var xattrs []string
+	for _, attr := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		valueSize, err := unix.Lgetxattr(file, attr, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Lgetxattr(file, attr, value); err != nil {
+			return nil, err
+		}
+		xattrs = append(xattrs, attr+"="+string(value[:valueSize]))
+	}
+	sort.Strings(xattrs)
+	return xattrs, nil
+}
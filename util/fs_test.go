@@ -0,0 +1,57 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTreeDigest(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "etc/passwd"), []byte("root:x:0:0::/root:/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("etc/passwd", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := TreeDigest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual, _ := TreeDigest(dir); actual != expected {
+		t.Fatalf("digest of the same tree changed from %s to %s", expected, actual)
+	}
+	modifications := map[string]func() error{
+		"content": func() error {
+			return os.WriteFile(filepath.Join(dir, "etc/passwd"), []byte("root:x:0:0::/root:/bin/bash\n"), 0644)
+		},
+		"mode": func() error {
+			return os.Chmod(filepath.Join(dir, "etc/passwd"), 0666)
+		},
+		"symlink": func() error {
+			if err := os.Remove(filepath.Join(dir, "link")); err != nil {
+				return err
+			}
+			return os.Symlink("/etc/shadow", filepath.Join(dir, "link"))
+		},
+		"new file": func() error {
+			return os.WriteFile(filepath.Join(dir, "etc/shadow"), nil, 0600)
+		},
+	}
+	for name, modify := range modifications {
+		if err := modify(); err != nil {
+			t.Fatal(err)
+		}
+		actual, err := TreeDigest(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual == expected {
+			t.Errorf("%s: digest did not change", name)
+		}
+		expected = actual
+	}
+}
@@ -0,0 +1,47 @@
+package util
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+	"syscall"
+)
+
+const (
+	// WhiteoutPrefix OCI layer中表示删除文件的前缀
+	WhiteoutPrefix = ".wh."
+	// WhiteoutOpaqueDir OCI layer中表示目录为opaque的文件名
+	WhiteoutOpaqueDir = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+)
+
+// overlay标记目录为opaque的xattr，rootless挂载使用user.前缀
+var opaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
+
+// IsOverlayWhiteout overlay使用0/0设备号的字符设备表示删除的文件
+func IsOverlayWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+// IsOverlayOpaque 判断目录是否被标记为opaque，opaque目录隐藏下层layer中该目录的内容
+func IsOverlayOpaque(dir string) bool {
+	buf := make([]byte, 1)
+	for _, attr := range opaqueXattrs {
+		if n, err := unix.Lgetxattr(dir, attr, buf); err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// MakeOverlayWhiteout 创建0/0设备号的字符设备，在overlay中隐藏下层layer的同名文件
+func MakeOverlayWhiteout(file string) error {
+	return unix.Mknod(file, unix.S_IFCHR, 0)
+}
+
+// SetOverlayOpaque 将目录标记为opaque
+func SetOverlayOpaque(dir string) error {
+	return unix.Lsetxattr(dir, opaqueXattrs[0], []byte("y"), 0)
+}
@@ -2,77 +2,430 @@ package util
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"errors"
 	"fmt"
+	"golang.org/x/sys/unix"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 )
 
 func Untar(tarFile string, target string) error {
-	// 创建目标目录
-	if err := os.MkdirAll(target, 0644); err != nil {
-		return err
-	}
 	file, err := os.OpenFile(tarFile, os.O_RDONLY, 0444)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	var reader *tar.Reader
-	if strings.HasSuffix(tarFile, ".gz") {
-		gr, err := gzip.NewReader(file)
+	r, _, err := DecompressReader(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return UntarReader(r, target, nil)
+}
+
+// UntarReader 从r读取tar解压到target目录，保留权限、所有者和修改时间。
+// 所有路径都在target内解析，不会通过..或符号链接写到target之外。rename不为nil时用来改写归档中的路径
+func UntarReader(r io.Reader, target string, rename func(name string) string) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	return extractTar(r, target, extractOptions{rename: rename})
+}
+
+// UntarToHost 将不可信的tar（例如从容器中打包的文件）解压到宿主机的target目录。
+// 所有文件属于uid和gid，清除setuid和setgid位，不恢复扩展属性，跳过字符设备、块设备和FIFO
+func UntarToHost(r io.Reader, target string, uid, gid int) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	return extractTar(r, target, extractOptions{owner: &owner{uid: uid, gid: gid}})
+}
+
+// UntarLayer 解压OCI layer，.wh.文件转换为overlay的whiteout字符设备，.wh..wh..opq转换为目录的opaque xattr
+func UntarLayer(r io.Reader, target string) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	return extractTar(r, target, extractOptions{whiteouts: true})
+}
+
+// convertWhiteout 将OCI的whiteout文件转换为overlay的格式，fileName是whiteout文件在target中的路径。
+// 被删除的文件名必须是一个普通的路径元素，.wh..和.wh...会指向target或它的父目录
+func convertWhiteout(target, fileName string) error {
+	dir, base := filepath.Split(fileName)
+	if base == WhiteoutOpaqueDir {
+		return SetOverlayOpaque(dir)
+	}
+	name := strings.TrimPrefix(base, WhiteoutPrefix)
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid whiteout %q", base)
+	}
+	deleted := filepath.Join(dir, name)
+	if rel, err := filepath.Rel(target, deleted); err != nil || rel == "." || escapesRoot(rel) {
+		return fmt.Errorf("invalid whiteout %q: path escapes the target directory", base)
+	}
+	if err := os.RemoveAll(deleted); err != nil {
+		return err
+	}
+	return MakeOverlayWhiteout(deleted)
+}
+
+// TarPath 将src打包为tar写入w，归档中src的路径为name，保留权限、所有者和修改时间
+func TarPath(src, name string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	if err := tarTree(tw, src, name, tarOptions{}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// TarLayer 将overlay的upperdir打包为OCI layer，whiteout字符设备转换为.wh.文件，opaque目录写入.wh..wh..opq
+func TarLayer(dir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	if err := tarTree(tw, dir, "", tarOptions{whiteouts: true}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// TarRootfs 将根文件系统打包为tar，exclude中的目录（如挂载点）只保留目录本身，不打包其中的内容
+func TarRootfs(root string, exclude []string, w io.Writer) error {
+	excluded := make(map[string]bool)
+	for _, dir := range exclude {
+		excluded[filepath.Clean(dir)] = true
+	}
+	tw := tar.NewWriter(w)
+	if err := tarTree(tw, root, "", tarOptions{exclude: excluded}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// paxXattrPrefix tar的PAX记录中保存扩展属性的前缀
+const paxXattrPrefix = "SCHILY.xattr."
+
+type tarOptions struct {
+	// whiteouts 将overlay的whiteout转换为OCI格式
+	whiteouts bool
+	// exclude 不打包内容的目录
+	exclude map[string]bool
+}
+
+func tarTree(tw *tar.Writer, src, name string, opts tarOptions) error {
+	// 同一个inode的文件只写一次，之后的路径写为硬链接
+	inodes := make(map[uint64]string)
+	return filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		entryName := filepath.ToSlash(filepath.Join(name, rel))
+		if entryName == "." {
+			// layer中不包含根目录本身
+			return nil
+		}
+		if opts.whiteouts && IsOverlayWhiteout(info) {
+			return tw.WriteHeader(&tar.Header{
+				Name:     path.Join(path.Dir(entryName), WhiteoutPrefix+path.Base(entryName)),
+				Typeflag: tar.TypeReg,
+				Mode:     0600,
+				ModTime:  info.ModTime(),
+			})
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = entryName
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if header.PAXRecords, err = readXattrs(file); err != nil {
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && stat.Nlink > 1 {
+			if target, ok := inodes[stat.Ino]; ok {
+				header.Typeflag, header.Linkname, header.Size = tar.TypeLink, target, 0
+			} else {
+				inodes[stat.Ino] = entryName
+			}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if opts.whiteouts && info.IsDir() && IsOverlayOpaque(file) {
+			if err := tw.WriteHeader(&tar.Header{
+				Name:     path.Join(entryName, WhiteoutOpaqueDir),
+				Typeflag: tar.TypeReg,
+				Mode:     0600,
+				ModTime:  info.ModTime(),
+			}); err != nil {
+				return err
+			}
+		}
+		if info.IsDir() && opts.exclude[file] {
+			return filepath.SkipDir
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		f, err := os.Open(file)
 		if err != nil {
 			return err
 		}
-		defer gr.Close()
-		reader = tar.NewReader(gr)
-	} else {
-		reader = tar.NewReader(file)
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// readXattrs 读取文件的扩展属性，保存为tar的PAX记录，overlay自身使用的属性不保存
+func readXattrs(file string) (map[string]string, error) {
+	size, err := unix.Llistxattr(file, nil)
+	if err != nil || size == 0 {
+		return nil, nil
 	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(file, buf); err != nil {
+		return nil, err
+	}
+	records := make(map[string]string)
+	for _, attr := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if strings.HasPrefix(attr, "trusted.overlay.") || strings.HasPrefix(attr, "user.overlay.") {
+			continue
+		}
+		valueSize, err := unix.Lgetxattr(file, attr, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Lgetxattr(file, attr, value); err != nil {
+			return nil, err
+		}
+		records[paxXattrPrefix+attr] = string(value[:valueSize])
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	return records, nil
+}
+
+type extractOptions struct {
+	// rename 改写归档中的路径
+	rename func(name string) string
+	// whiteouts 将OCI格式的whiteout转换为overlay格式
+	whiteouts bool
+	// owner 不为nil时解压到宿主机，文件属于owner，不保留特殊权限位、扩展属性和设备文件
+	owner *owner
+}
+
+type owner struct {
+	uid, gid int
+}
 
-	hardLinks := make(map[string]string)
-	for header, err := reader.Next(); err != io.EOF; header, err = reader.Next() {
+func extractTar(r io.Reader, target string, opts extractOptions) error {
+	reader := tar.NewReader(r)
+	type dirEntry struct {
+		name   string
+		header *tar.Header
+	}
+	type linkEntry struct {
+		name     string
+		linkname string
+	}
+	var dirs []dirEntry
+	var links []linkEntry
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if opts.rename != nil {
+			header.Name = opts.rename(header.Name)
+			if header.Typeflag == tar.TypeLink {
+				header.Linkname = opts.rename(header.Linkname)
+			}
+		}
+		if escapesRoot(header.Name) {
+			return fmt.Errorf("invalid archive entry %q: path escapes the target directory", header.Name)
+		}
+		if header.Typeflag == tar.TypeLink && escapesRoot(header.Linkname) {
+			return fmt.Errorf("invalid hard link %q -> %q: target escapes the target directory", header.Name, header.Linkname)
+		}
+		fileName, err := secureEntryPath(target, header.Name)
 		if err != nil {
 			return err
 		}
-		fileName := filepath.Join(target, header.Name)
-		info := header.FileInfo()
+		if fileName == "" {
+			continue
+		}
+		if opts.owner != nil {
+			if header.Typeflag == tar.TypeChar || header.Typeflag == tar.TypeBlock || header.Typeflag == tar.TypeFifo {
+				continue
+			}
+			header.Uid, header.Gid = opts.owner.uid, opts.owner.gid
+			header.Mode &^= unix.S_ISUID | unix.S_ISGID
+			header.PAXRecords = nil
+		}
+		if opts.whiteouts && strings.HasPrefix(filepath.Base(fileName), WhiteoutPrefix) {
+			if err := convertWhiteout(target, fileName); err != nil {
+				return err
+			}
+			continue
+		}
+		// 已存在的非目录文件被归档中的条目替换
+		if info, err := os.Lstat(fileName); err == nil && !(info.IsDir() && header.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(fileName); err != nil {
+				return err
+			}
+		}
+		mode := uint32(header.FileInfo().Mode().Perm())
 		switch header.Typeflag {
 		case tar.TypeDir:
-			if _, err := os.Stat(fileName); os.IsNotExist(err) {
-				_ = os.MkdirAll(fileName, 0644)
+			if err := os.MkdirAll(fileName, 0755); err != nil {
+				return err
 			}
+			// 目录的权限在内容解压完成后再设置，避免只读目录无法写入
+			dirs = append(dirs, dirEntry{name: header.Name, header: header})
+			continue
 		case tar.TypeReg:
-			if _, err := os.Stat(filepath.Dir(fileName)); os.IsNotExist(err) {
-				_ = os.MkdirAll(filepath.Dir(fileName), 0644)
-			}
-			f, err := os.OpenFile(fileName, os.O_CREATE|os.O_TRUNC|os.O_RDWR, info.Mode().Perm())
+			f, err := os.OpenFile(fileName, os.O_CREATE|os.O_EXCL|os.O_WRONLY|unix.O_NOFOLLOW, os.FileMode(mode))
 			if err != nil {
 				return err
 			}
-			if _, err := io.Copy(f, reader); err != nil {
+			_, err = io.Copy(f, reader)
+			f.Close()
+			if err != nil {
 				return err
 			}
 		case tar.TypeLink:
-			// 硬链接目标文件可能还未解压，记录链接关系
-			linkPath := filepath.Join(target, header.Linkname)
-			hardLinks[fileName] = linkPath
+			linkPath, err := SecureJoin(target, header.Linkname)
+			if err != nil {
+				return err
+			}
+			// 硬链接的目标文件可能还未解压，全部解压后再创建
+			if _, err := os.Lstat(linkPath); os.IsNotExist(err) {
+				links = append(links, linkEntry{name: header.Name, linkname: header.Linkname})
+				continue
+			}
+			if err := os.Link(linkPath, fileName); err != nil {
+				return err
+			}
+			continue
 		case tar.TypeSymlink:
-			// 符号链接的linkName已经是绝对地址，不需要Join
 			if err := os.Symlink(header.Linkname, fileName); err != nil {
 				return err
 			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			fileType := map[byte]uint32{tar.TypeChar: unix.S_IFCHR, tar.TypeBlock: unix.S_IFBLK, tar.TypeFifo: unix.S_IFIFO}
+			dev := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+			if err := unix.Mknod(fileName, fileType[header.Typeflag]|mode, int(dev)); err != nil {
+				return err
+			}
 		default:
-			return fmt.Errorf("unsupported file type : %c", header.Typeflag)
+			continue
+		}
+		if err := restoreMetadata(fileName, header); err != nil {
+			return err
+		}
+	}
+	// 之后的条目可能把路径中的目录替换为符号链接，重新在target内解析路径
+	for _, link := range links {
+		fileName, err := secureEntryPath(target, link.name)
+		if err != nil {
+			return err
+		}
+		linkPath, err := SecureJoin(target, link.linkname)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(linkPath, fileName); err != nil {
+			return err
 		}
 	}
-	// 创建硬链接
-	for newName, oldName := range hardLinks {
-		if err := os.Link(oldName, newName); err != nil {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		// 目录或它的父目录可能已经被之后的条目替换为符号链接，重新在target内解析父目录，
+		// 目录本身是符号链接时跳过，chmod会修改链接指向的文件
+		clean := filepath.Clean("/" + dirs[i].name)
+		parent, err := SecureJoin(target, filepath.Dir(clean))
+		if err != nil {
+			continue
+		}
+		dirPath := filepath.Join(parent, filepath.Base(clean))
+		if info, err := os.Lstat(dirPath); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := restoreMetadata(dirPath, dirs[i].header); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// escapesRoot 归档中的相对路径是否通过..指向根目录之外
+func escapesRoot(name string) bool {
+	if filepath.IsAbs(name) {
+		return false
+	}
+	clean := filepath.Clean(name)
+	return clean == ".." || strings.HasPrefix(clean, "../")
+}
+
+// secureEntryPath 返回归档条目在target中的路径，父目录中的符号链接在target内解析并创建父目录。
+// 条目本身不解析，已存在的符号链接会被替换而不是跟随，条目是根目录时返回空字符串
+func secureEntryPath(target, name string) (string, error) {
+	clean := filepath.Clean("/" + name)
+	if clean == "/" {
+		return "", nil
+	}
+	parent, err := SecureJoin(target, filepath.Dir(clean))
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(clean)), nil
+}
+
+// restoreMetadata 设置文件的所有者、权限、扩展属性和修改时间，符号链接只设置所有者、扩展属性和时间
+func restoreMetadata(fileName string, header *tar.Header) error {
+	if err := os.Lchown(fileName, header.Uid, header.Gid); err != nil {
+		return err
+	}
+	if header.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(fileName, header.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+	// chown会清除security.capability，扩展属性在chown之后设置
+	for key, value := range header.PAXRecords {
+		attr, ok := strings.CutPrefix(key, paxXattrPrefix)
+		if !ok {
+			continue
+		}
+		if err := unix.Lsetxattr(fileName, attr, []byte(value), 0); err != nil && !errors.Is(err, unix.ENOTSUP) {
+			return fmt.Errorf("unable to set xattr %s on %s %w", attr, fileName, err)
+		}
+	}
+	times := []unix.Timespec{unix.NsecToTimespec(header.AccessTime.UnixNano()), unix.NsecToTimespec(header.ModTime.UnixNano())}
+	if header.AccessTime.IsZero() {
+		times[0] = times[1]
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, fileName, times, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,437 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+}
+
+// buildTar 创建只包含给定条目的tar
+func buildTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0644, Size: int64(len(e.body))}
+		if e.typeflag == tar.TypeDir {
+			header.Mode = 0755
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// skipIfNotPermitted 没有创建设备文件或设置trusted xattr的权限时跳过测试
+func skipIfNotPermitted(t *testing.T, err error) {
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.ENOTSUP) {
+		t.Skip("not permitted to create overlay whiteouts: ", err)
+	}
+}
+
+func TestUntarLayerWhiteouts(t *testing.T) {
+	target := t.TempDir()
+	layer := buildTar(t, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/" + WhiteoutPrefix + "passwd", typeflag: tar.TypeReg},
+		{name: "etc/hosts", typeflag: tar.TypeReg, body: "127.0.0.1 localhost\n"},
+		{name: "var/", typeflag: tar.TypeDir},
+		{name: "var/" + WhiteoutOpaqueDir, typeflag: tar.TypeReg},
+		{name: "var/new", typeflag: tar.TypeReg, body: "new"},
+		{name: WhiteoutPrefix + "tmp", typeflag: tar.TypeReg},
+	})
+	err := UntarLayer(layer, target)
+	skipIfNotPermitted(t, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, deleted := range []string{"etc/passwd", "tmp"} {
+		info, err := os.Lstat(filepath.Join(target, deleted))
+		if err != nil {
+			t.Fatalf("whiteout for %s not created: %v", deleted, err)
+		}
+		if !IsOverlayWhiteout(info) {
+			t.Errorf("%s is %v, expected a 0/0 char device", deleted, info.Mode())
+		}
+	}
+	if !IsOverlayOpaque(filepath.Join(target, "var")) {
+		t.Error("var is not marked opaque")
+	}
+	if IsOverlayOpaque(filepath.Join(target, "etc")) {
+		t.Error("etc should not be opaque")
+	}
+	for _, name := range []string{"etc/" + WhiteoutPrefix + "passwd", "var/" + WhiteoutOpaqueDir, WhiteoutPrefix + "tmp"} {
+		if _, err := os.Lstat(filepath.Join(target, name)); !os.IsNotExist(err) {
+			t.Errorf("whiteout marker %s should not be extracted", name)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(target, "var/new")); err != nil || string(data) != "new" {
+		t.Errorf("var/new = %q, %v", data, err)
+	}
+}
+
+func TestUntarKeepsWhiteoutFiles(t *testing.T) {
+	target := t.TempDir()
+	archive := buildTar(t, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/" + WhiteoutPrefix + "passwd", typeflag: tar.TypeReg},
+	})
+	if err := UntarReader(archive, target, nil); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(filepath.Join(target, "etc", WhiteoutPrefix+"passwd"))
+	if err != nil || !info.Mode().IsRegular() {
+		t.Errorf("whiteout file should be kept as a regular file outside layers: %v", err)
+	}
+}
+
+func TestTarLayerRoundTrip(t *testing.T) {
+	upper := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(upper, "opaque"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := MakeOverlayWhiteout(filepath.Join(upper, "deleted"))
+	if err == nil {
+		err = SetOverlayOpaque(filepath.Join(upper, "opaque"))
+	}
+	skipIfNotPermitted(t, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := TarLayer(upper, buf); err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+	if err := UntarLayer(buf, target); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Lstat(filepath.Join(target, "deleted")); err != nil || !IsOverlayWhiteout(info) {
+		t.Errorf("deleted is not a whiteout after round trip: %v", err)
+	}
+	if !IsOverlayOpaque(filepath.Join(target, "opaque")) {
+		t.Error("opaque dir lost its xattr after round trip")
+	}
+}
+
+func TestUntarPreservesMetadata(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must run as root to restore ownership and create device nodes")
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	headers := []*tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0700, Uid: 1000, Gid: 1000, ModTime: mtime},
+		// 硬链接在目标文件之前出现
+		{Name: "bin/su-link", Typeflag: tar.TypeLink, Linkname: "bin/su"},
+		{Name: "bin/su", Typeflag: tar.TypeReg, Mode: 04755, Size: 2, ModTime: mtime,
+			PAXRecords: map[string]string{paxXattrPrefix + "trusted.test": "value"}},
+		{Name: "tmp/", Typeflag: tar.TypeDir, Mode: 01777, ModTime: mtime},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+		{Name: "run/fifo", Typeflag: tar.TypeFifo, Mode: 0600},
+	}
+	for _, h := range headers {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Size > 0 {
+			_, _ = tw.Write([]byte("su"))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+	err := UntarReader(buf, target, nil)
+	skipIfNotPermitted(t, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(target, "bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	if info.Mode().Perm() != 0700 || stat.Uid != 1000 || stat.Gid != 1000 || !info.ModTime().Equal(mtime) {
+		t.Errorf("bin: mode %v uid %d gid %d mtime %v", info.Mode(), stat.Uid, stat.Gid, info.ModTime())
+	}
+	su, err := os.Stat(filepath.Join(target, "bin/su"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if su.Mode()&os.ModeSetuid == 0 || su.Mode().Perm() != 0755 {
+		t.Errorf("bin/su mode = %v, expected setuid 0755", su.Mode())
+	}
+	link, err := os.Stat(filepath.Join(target, "bin/su-link"))
+	if err != nil || !os.SameFile(su, link) {
+		t.Errorf("bin/su-link is not a hard link to bin/su: %v", err)
+	}
+	value := make([]byte, 16)
+	if n, err := unix.Lgetxattr(filepath.Join(target, "bin/su"), "trusted.test", value); err != nil || string(value[:n]) != "value" {
+		t.Errorf("xattr not restored: %q %v", value, err)
+	}
+	if tmp, err := os.Stat(filepath.Join(target, "tmp")); err != nil || tmp.Mode()&os.ModeSticky == 0 {
+		t.Errorf("tmp lost the sticky bit: %v", err)
+	}
+	null, err := os.Stat(filepath.Join(target, "dev/null"))
+	if err != nil || null.Mode()&os.ModeCharDevice == 0 || null.Sys().(*syscall.Stat_t).Rdev != unix.Mkdev(1, 3) {
+		t.Errorf("dev/null is not the 1:3 char device: %v", err)
+	}
+	if fifo, err := os.Stat(filepath.Join(target, "run/fifo")); err != nil || fifo.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("run/fifo is not a fifo: %v", err)
+	}
+}
+
+func TestUntarToHostDropsPrivileges(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must run as root to write archives owned by root")
+	}
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	headers := []*tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 02755},
+		{Name: "bin/su", Typeflag: tar.TypeReg, Mode: 06755, Size: 2,
+			PAXRecords: map[string]string{paxXattrPrefix + "security.capability": "caps"}},
+		{Name: "dev/sda", Typeflag: tar.TypeBlock, Mode: 0666, Devmajor: 8},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+		{Name: "run/fifo", Typeflag: tar.TypeFifo, Mode: 0600},
+	}
+	for _, h := range headers {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Size > 0 {
+			_, _ = tw.Write([]byte("su"))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+	if err := UntarToHost(buf, target, 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"bin", "bin/su"} {
+		info, err := os.Lstat(filepath.Join(target, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if stat.Uid != 1000 || stat.Gid != 1000 {
+			t.Errorf("%s owned by %d:%d, expected 1000:1000", name, stat.Uid, stat.Gid)
+		}
+		if info.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 || info.Mode().Perm() != 0755 {
+			t.Errorf("%s mode = %v, expected 0755 without setuid and setgid", name, info.Mode())
+		}
+	}
+	if n, err := unix.Lgetxattr(filepath.Join(target, "bin/su"), "security.capability", nil); err == nil {
+		t.Errorf("xattr of %d bytes restored on the host", n)
+	}
+	for _, name := range []string{"dev/sda", "dev/null", "run/fifo"} {
+		if _, err := os.Lstat(filepath.Join(target, name)); !os.IsNotExist(err) {
+			t.Errorf("special file %s created on the host: %v", name, err)
+		}
+	}
+}
+
+// assertEmptyDir 检查恶意归档没有在target之外写入文件
+func assertEmptyDir(t *testing.T, dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("%s was written outside the target directory", filepath.Join(dir, e.Name()))
+	}
+}
+
+func TestUntarLayerRejectsDotWhiteouts(t *testing.T) {
+	for _, name := range []string{WhiteoutPrefix + ".", WhiteoutPrefix + "..", "dir/" + WhiteoutPrefix + ".."} {
+		// target的父目录模拟共享的layer目录，其他layer不能被删除
+		root := t.TempDir()
+		target := filepath.Join(root, "layer")
+		if err := os.WriteFile(filepath.Join(root, "other"), []byte("other layer"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		layer := buildTar(t, []tarEntry{
+			{name: "dir/", typeflag: tar.TypeDir},
+			{name: name, typeflag: tar.TypeReg},
+		})
+		if err := UntarLayer(layer, target); err == nil {
+			t.Errorf("%s: expected an error for an invalid whiteout", name)
+		}
+		if _, err := os.Stat(filepath.Join(root, "other")); err != nil {
+			t.Errorf("%s: file outside the target was deleted: %v", name, err)
+		}
+		if info, err := os.Lstat(target); err != nil || !info.IsDir() {
+			t.Errorf("%s: target was replaced: %v", name, err)
+		}
+		if info, err := os.Lstat(filepath.Join(target, "dir")); err != nil || !info.IsDir() {
+			t.Errorf("%s: dir was replaced: %v", name, err)
+		}
+	}
+}
+
+func TestUntarRejectsParentEscape(t *testing.T) {
+	root := t.TempDir()
+	target := filepath.Join(root, "target")
+	archive := buildTar(t, []tarEntry{
+		{name: "../escape", typeflag: tar.TypeReg, body: "evil"},
+	})
+	if err := UntarReader(archive, target, nil); err == nil {
+		t.Error("expected an error for an entry outside the target")
+	}
+	if _, err := os.Lstat(filepath.Join(root, "escape")); !os.IsNotExist(err) {
+		t.Error("../escape was written outside the target")
+	}
+}
+
+func TestUntarSymlinkConfinedToRoot(t *testing.T) {
+	host := t.TempDir()
+	target := t.TempDir()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	headers := []*tar.Header{
+		// 指向宿主机绝对路径的符号链接
+		{Name: "abs", Typeflag: tar.TypeSymlink, Linkname: host},
+		{Name: "abs/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		// 通过..向上跳出target的符号链接
+		{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "../../../../../../../.." + host},
+		{Name: "up/evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+	}
+	for _, h := range headers {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Size > 0 {
+			_, _ = tw.Write([]byte("evil"))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := UntarReader(buf, target, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertEmptyDir(t, host)
+	// 符号链接在target内解析，文件写入target中对应的路径
+	for _, name := range []string{"file", "evil"} {
+		if _, err := os.Stat(filepath.Join(target, host, name)); err != nil {
+			t.Errorf("%s not extracted inside the target: %v", name, err)
+		}
+	}
+}
+
+func TestUntarRejectsHardlinkEscape(t *testing.T) {
+	target := t.TempDir()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := UntarReader(buf, target, nil); err == nil {
+		t.Error("expected an error for a hard link outside the target")
+	}
+	if _, err := os.Lstat(filepath.Join(target, "passwd")); !os.IsNotExist(err) {
+		t.Error("hard link to a file outside the target was created")
+	}
+}
+
+func TestUntarDirReplacedBySymlink(t *testing.T) {
+	host := t.TempDir()
+	if err := os.Chmod(host, 0700); err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	headers := []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0777},
+		// 目录之后被替换为指向宿主机目录的符号链接，恢复目录权限时不能跟随
+		{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: host},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644},
+	}
+	for _, h := range headers {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := UntarReader(buf, target, nil); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("host dir mode changed to %v", info.Mode().Perm())
+	}
+	assertEmptyDir(t, host)
+}
+
+func TestUntarParentReplacedBySymlink(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must run as root to restore ownership")
+	}
+	host := t.TempDir()
+	victim := filepath.Join(host, "victim")
+	if err := os.Mkdir(victim, 0700); err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	headers := []*tar.Header{
+		{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "a/victim/", Typeflag: tar.TypeDir, Mode: 0777, Uid: 4242, Gid: 4242},
+		// 父目录之后被替换为指向宿主机目录的符号链接，恢复a/victim的元数据时不能修改宿主机的victim
+		{Name: "a", Typeflag: tar.TypeSymlink, Linkname: host},
+	}
+	for _, h := range headers {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := UntarReader(buf, target, nil); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(victim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("host dir mode changed to %v", info.Mode().Perm())
+	}
+	if stat := info.Sys().(*syscall.Stat_t); stat.Uid != 0 || stat.Gid != 0 {
+		t.Errorf("host dir owner changed to %d:%d", stat.Uid, stat.Gid)
+	}
+}